@@ -0,0 +1,39 @@
+package heartbeat
+
+import (
+	"net/http"
+	"time"
+)
+
+const maxReasonBytes = 256
+
+// AccessRecord describe one request to the beat endpoint
+type AccessRecord struct {
+	Identifier string // empty if the request was rejected before it is known, passed through AnonymizeFunc
+	Status     int    // HTTP status code sent to client
+	Reason     string // error message for rejected requests, empty on success
+	Latency    time.Duration
+	RemoteAddr string
+}
+
+// accessRecorder capture status code and error message for the access log
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	reason []byte
+}
+
+func (a *accessRecorder) WriteHeader(code int) {
+	a.status = code
+	a.ResponseWriter.WriteHeader(code)
+}
+
+func (a *accessRecorder) Write(b []byte) (int, error) {
+	if a.status != http.StatusOK && len(a.reason) < maxReasonBytes {
+		a.reason = append(a.reason, b...)
+		if len(a.reason) > maxReasonBytes {
+			a.reason = a.reason[:maxReasonBytes]
+		}
+	}
+	return a.ResponseWriter.Write(b)
+}
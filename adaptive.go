@@ -0,0 +1,111 @@
+package heartbeat
+
+import (
+	"time"
+)
+
+const (
+	rttWeight  = 0.125 // same weight as TCP SRTT
+	lossWeight = 0.25
+)
+
+// observe record the result of one beat into the smoothed RTT and loss ratio
+func (c *Client) observe(rtt time.Duration, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.loss += lossWeight * (1 - c.loss)
+		return
+	}
+	c.loss -= lossWeight * c.loss
+	if c.rtt == 0 {
+		c.rtt = rtt
+	} else {
+		c.rtt += time.Duration(rttWeight * float64(rtt-c.rtt))
+	}
+}
+
+// RTT return the smoothed round trip time of beats
+func (c *Client) RTT() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rtt
+}
+
+// Interval return the current effective beat interval
+func (c *Client) Interval() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.interval
+}
+
+// nextInterval return how long to wait before next beat.
+// Without Adaptive, it is always the base interval.
+//
+// With Adaptive, the interval grows by half when the link looks unhealthy
+// (loss over 10% or RTT over a quarter of the interval) so a struggling
+// link is not piled on, and shrinks back by a quarter of the distance
+// to the lower bound when the link is healthy.
+func (c *Client) nextInterval(base time.Duration) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.Adaptive {
+		c.interval = base
+		return base
+	}
+	lower, upper := c.MinInterval, 2*base
+	if lower <= 0 {
+		lower = base
+	}
+	if c.ServerTimeout > 0 {
+		// leave room for two lost beats before the server timeout
+		upper = c.ServerTimeout / 3
+	}
+	if upper < lower {
+		upper = lower
+	}
+	cur := c.interval
+	if cur == 0 {
+		cur = base
+	}
+	if c.loss > 0.1 || c.rtt > cur/4 {
+		cur += cur / 2
+	} else {
+		cur -= (cur - lower) / 4
+	}
+	if cur < lower {
+		cur = lower
+	}
+	if cur > upper {
+		cur = upper
+	}
+	c.interval = cur
+	return cur
+}
+
+// degradedInterval return the survival beat interval after a failed beat,
+// ok is false when the server must have dropped the session already. must hold c.mu
+func (c *Client) degradedInterval(base time.Duration, err error) (d time.Duration, ok bool) {
+	if c.DegradedInterval <= 0 || IsStaleTimestamp(err) || isReplayed(err) || permanentError(err) != nil {
+		return 0, false
+	}
+	window := c.ServerTimeout
+	if window <= 0 {
+		window = 3 * base
+	}
+	d = c.DegradedInterval
+	if d >= window {
+		d = window / 2
+	}
+	if time.Since(c.lastOK)+d >= window {
+		return 0, false
+	}
+	return d, true
+}
+
+// Degraded report whether the client is beating at DegradedInterval after failures
+func (c *Client) Degraded() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.degraded
+}
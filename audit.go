@@ -0,0 +1,83 @@
+package heartbeat
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codeskyblue/realip"
+)
+
+// RejectedBeat is one rejected request kept for auditors, see RejectionAudit
+type RejectedBeat struct {
+	Time       time.Time
+	RemoteAddr string
+	Identifier string // as claimed by the request, passed through AnonymizeFunc, may be forged
+	Status     int
+	Reason     string
+	MAC        string // first 8 hex digits of messageMAC or signature, enough to match replays
+}
+
+// auditRing keep the last rejected beats, oldest overwritten first
+type auditRing struct {
+	mu      sync.Mutex
+	entries []RejectedBeat
+	next    int
+	full    bool
+	seen    uint64
+}
+
+const redactedMACLen = 8
+
+func redactMAC(mac string) string {
+	if len(mac) <= redactedMACLen {
+		return mac
+	}
+	return mac[:redactedMACLen] + "..."
+}
+
+// auditRejection keep a rejected request in the ring, 1 out of RejectionAuditSample
+func (s *Server) auditRejection(r *http.Request, identifier string, status int, reason string) {
+	s.audit.mu.Lock()
+	defer s.audit.mu.Unlock()
+	s.audit.seen++
+	if every := uint64(s.RejectionAuditSample); every > 1 && (s.audit.seen-1)%every != 0 {
+		return
+	}
+	if len(s.audit.entries) != s.RejectionAudit {
+		s.audit.entries = make([]RejectedBeat, s.RejectionAudit)
+		s.audit.next, s.audit.full = 0, false
+	}
+	mac := r.FormValue("messageMAC")
+	if mac == "" {
+		mac = r.FormValue(fieldSignature)
+	}
+	s.audit.entries[s.audit.next] = RejectedBeat{
+		Time:       s.now(),
+		RemoteAddr: realip.FromRequest(r),
+		Identifier: s.anonymize(identifier),
+		Status:     status,
+		Reason:     strings.TrimSpace(reason),
+		MAC:        redactMAC(mac),
+	}
+	s.audit.next = (s.audit.next + 1) % len(s.audit.entries)
+	if s.audit.next == 0 {
+		s.audit.full = true
+	}
+}
+
+// RejectedBeats return the audited rejections, oldest first.
+// Only the last RejectionAudit sampled rejections are kept, there is no time based expiry,
+// and the ring lives in memory only. RejectionAuditSample N keep 1 out of N rejections
+// (the 1st, N+1th, ...), so one attacker can not flush the ring of everything else as fast.
+func (s *Server) RejectedBeats() []RejectedBeat {
+	s.audit.mu.Lock()
+	defer s.audit.mu.Unlock()
+	if !s.audit.full {
+		return append([]RejectedBeat(nil), s.audit.entries[:s.audit.next]...)
+	}
+	out := make([]RejectedBeat, 0, len(s.audit.entries))
+	out = append(out, s.audit.entries[s.audit.next:]...)
+	return append(out, s.audit.entries[:s.audit.next]...)
+}
@@ -0,0 +1,90 @@
+package heartbeat
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+Retry delays of DoBeat, see NextBeatAfter ->
+
+  - a failed handshake is retried after the beat interval, plus up to 5s of jitter
+  - a failed beat reconnect at once, the next request is a new handshake
+  - a permanent rejection (wrong secret, blocked identifier, revoked key, refused build, see permanentError)
+    back off exponentially: the beat interval doubled on each rejection in a row, up to maxRejectBackoff,
+    plus up to a quarter of jitter. Retrying alone can not fix them, an operator can (Unblock, lower
+    MinBuild), so the client keep trying, slowly. An accepted beat reset the backoff.
+  - a 503 or 429 wait its Retry-After (sent by a busy server, a full group quota or a cadence violation)
+    plus up to a quarter of jitter, or about the beat interval without one, so an overloaded server is not
+    hit again at once. Announced restarts (Server.Drain) keep their fast retry.
+*/
+
+const maxRejectBackoff = 10 * time.Minute
+
+// rejectBackoff return the wait after the nth permanent rejection in a row, n >= 1
+func rejectBackoff(base time.Duration, n int) time.Duration {
+	d := base
+	for i := 1; i < n && d < maxRejectBackoff; i++ {
+		d *= 2
+	}
+	if d > maxRejectBackoff {
+		d = maxRejectBackoff
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/4+1))
+}
+
+// retryAfterBusy is the Retry-After of a server whose work queue is full
+const retryAfterBusy = time.Second
+
+// retryLaterError is a 503 or 429 answer, after is its Retry-After, zero when missing
+type retryLaterError struct {
+	msg   string
+	after time.Duration
+}
+
+func (e *retryLaterError) Error() string {
+	return e.msg
+}
+
+// replyError build the error of a non 200 answer
+func replyError(resp *http.Response, body string) error {
+	if resp.StatusCode != http.StatusServiceUnavailable && resp.StatusCode != http.StatusTooManyRequests {
+		return errors.New(body)
+	}
+	e := &retryLaterError{msg: body}
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+			e.after = time.Duration(secs) * time.Second
+		} else if t, err := http.ParseTime(v); err == nil {
+			e.after = time.Until(t)
+		}
+	}
+	return e
+}
+
+// retryLaterWait return how long to wait after err, ok is false when err is not a 503 or 429,
+// or has no Retry-After during an announced restart
+func retryLaterWait(base time.Duration, err error, restarting bool) (d time.Duration, ok bool) {
+	e, ok := errors.Cause(err).(*retryLaterError)
+	if !ok {
+		return 0, false
+	}
+	d = e.after
+	if d <= 0 {
+		if restarting {
+			return 0, false
+		}
+		d = base
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/4+1)), true
+}
+
+// writeRetryAfter answer code with a Retry-After of d
+func writeRetryAfter(w http.ResponseWriter, msg string, code int, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((d+time.Second-1)/time.Second)))
+	http.Error(w, msg, code)
+}
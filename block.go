@@ -0,0 +1,37 @@
+package heartbeat
+
+import "sort"
+
+// Block refuse beats of identifier with 403 until Unblock, even with the right secret.
+// The active session of identifier is disconnected immediately, calling OnDisconnect.
+// The blocklist lives in memory only.
+func (s *Server) Block(identifier string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.blocked == nil {
+		s.blocked = make(map[string]bool)
+	}
+	s.blocked[identifier] = true
+	if sess, ok := s.sessions[identifier]; ok {
+		s.disconnect(sess, ReasonBlocked)
+	}
+}
+
+// Unblock allow identifier to connect again
+func (s *Server) Unblock(identifier string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blocked, identifier)
+}
+
+// Blocked return the sorted blocked identifiers
+func (s *Server) Blocked() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.blocked))
+	for id := range s.blocked {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
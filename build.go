@@ -0,0 +1,132 @@
+package heartbeat
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+/*
+Build identifier ->
+
+	Request extra: build, the Client.Build of the client, e.g. "1.4.2+a1b2c3d"
+
+A build is "{version}+{commit}", both optional parts, at most maxBuildBytes. The server keep the build of
+the last beat per session (SessionInfo.Build) and count the online sessions per build (Builds).
+
+MinBuild gate compare the version part only, the commit after "+" is ignored:
+
+  - a leading "v" is dropped, then the version is split on "."
+  - components are compared numerically left to right, missing components count as 0: 1.4 == 1.4.0
+  - a pre-release after "-" sort before the release: 1.4.0-rc1 < 1.4.0, pre-releases compare as strings
+  - a build whose version is not numeric (e.g. a bare commit hash) is below any MinBuild
+
+Beats below MinBuild are refused with 403 "build below minimum" (426 would need an HTTP Upgrade header),
+beats without build with 400 "build required" when RequireBuild or MinBuild is set, handshakes included. Both are permanent errors for the client, retrying does not fix them.
+AuthFunc beats are checked alike, on the unsigned extra they carry.
+*/
+
+const (
+	fieldBuild    = "build"
+	maxBuildBytes = 128
+)
+
+// checkBuild apply RequireBuild and MinBuild to the build of a beat
+func (s *Server) checkBuild(w http.ResponseWriter, extra url.Values) bool {
+	build := extra.Get(fieldBuild)
+	if len(build) > maxBuildBytes {
+		http.Error(w, "build too long", http.StatusBadRequest)
+		return false
+	}
+	if !s.RequireBuild && s.MinBuild == "" {
+		return true
+	}
+	if build == "" {
+		http.Error(w, "build required", http.StatusBadRequest)
+		return false
+	}
+	if s.MinBuild != "" && CompareBuilds(build, s.MinBuild) < 0 {
+		http.Error(w, "build below minimum "+s.MinBuild, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// storeBuild keep the build of a beat on sess, must hold s.mu
+func (s *Server) storeBuild(sess *Session, extra url.Values) {
+	if build := extra.Get(fieldBuild); build != "" {
+		sess.build = build
+	}
+}
+
+// Builds return how many online sessions run each build, "" for clients not sending one
+func (s *Server) Builds() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[string]int)
+	for _, sess := range s.sessions {
+		counts[sess.build]++
+	}
+	return counts
+}
+
+// CompareBuilds return -1, 0 or 1 as the version of build a is below, equal or above the one of b,
+// see build.go for the semantics. A non numeric version is below any numeric one.
+func CompareBuilds(a, b string) int {
+	va, preA, okA := parseBuild(a)
+	vb, preB, okB := parseBuild(b)
+	switch {
+	case !okA && !okB:
+		return 0
+	case !okA:
+		return -1
+	case !okB:
+		return 1
+	}
+	for i := 0; i < len(va) || i < len(vb); i++ {
+		var x, y int
+		if i < len(va) {
+			x = va[i]
+		}
+		if i < len(vb) {
+			y = vb[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case preA == preB:
+		return 0
+	case preA == "":
+		return 1
+	case preB == "":
+		return -1
+	}
+	return strings.Compare(preA, preB)
+}
+
+func parseBuild(build string) (version []int, pre string, ok bool) {
+	if i := strings.IndexByte(build, '+'); i >= 0 {
+		build = build[:i]
+	}
+	if i := strings.IndexByte(build, '-'); i >= 0 {
+		build, pre = build[:i], build[i+1:]
+	}
+	build = strings.TrimPrefix(build, "v")
+	if build == "" {
+		return nil, "", false
+	}
+	for _, part := range strings.Split(build, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, "", false
+		}
+		version = append(version, n)
+	}
+	return version, pre, true
+}
@@ -0,0 +1,43 @@
+package heartbeat
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	fieldBye         = "bye"
+	defaultByeWindow = 5 * time.Second
+)
+
+// Bye tell the server the client is going offline, the session is closed at once
+// instead of timing out. Stop the beat loop (cancel of Beat) before calling Bye.
+func (c *Client) Bye(ctx context.Context) error {
+	c.mu.Lock()
+	timeKey := c.timeKey
+	c.bye = timeKey != ""
+	c.mu.Unlock()
+	if timeKey == "" {
+		return nil // no session on server
+	}
+	_, _, err := c.httpBeat(ctx, timeKey, c.Endpoint())
+	c.mu.Lock()
+	c.bye = false
+	c.timeKey = ""
+	c.setState(false, nil)
+	c.mu.Unlock()
+	return err
+}
+
+// bye close the session of identifier after a graceful bye, calling OnDisconnect.
+// With the default ReconnectPolicy, beats of identifier during ByeWindow are then ignored,
+// so a beat still in flight when the client said goodbye can not bring the session back.
+func (s *Server) bye(identifier string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.sessions[identifier]; ok {
+		s.disconnect(sess, ReasonBye)
+		return
+	}
+	s.noteEnded(identifier, ReasonBye, time.Time{})
+}
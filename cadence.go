@@ -0,0 +1,74 @@
+package heartbeat
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const defaultIntervalTolerance = 0.5
+
+// advertisedInterval return the interval advertised in extra, zero when none.
+// ok is false when RequireAdvertisedInterval refused the beat, handshakes included.
+func (s *Server) advertisedInterval(w http.ResponseWriter, extra url.Values) (advertised time.Duration, ok bool) {
+	if v := extra.Get(fieldInterval); v != "" {
+		ms, _ := strconv.ParseInt(v, 10, 64)
+		advertised = time.Duration(ms) * time.Millisecond
+	}
+	if advertised <= 0 && s.RequireAdvertisedInterval {
+		http.Error(w, "interval not advertised", http.StatusBadRequest)
+		return 0, false
+	}
+	return advertised, true
+}
+
+// checkCadence compare the gap since the previous beat of identifier with the interval it advertised.
+// A gap shorter than advertised*(1-IntervalTolerance) is a violation, rejected with 429 when RejectCadenceViolation is set,
+// with a Retry-After of the time left to the shortest gap accepted.
+func (s *Server) checkCadence(w http.ResponseWriter, identifier string, extra url.Values) bool {
+	advertised, ok := s.advertisedInterval(w, extra)
+	if !ok || advertised <= 0 {
+		return ok
+	}
+	tolerance := s.IntervalTolerance
+	if tolerance <= 0 {
+		tolerance = defaultIntervalTolerance
+	}
+	shortest := time.Duration(float64(advertised) * (1 - tolerance))
+
+	now := s.now()
+	s.mu.Lock()
+	sess, ok := s.sessions[identifier]
+	var gap time.Duration
+	violated := false
+	if ok {
+		if !sess.lastArrival.IsZero() {
+			gap = now.Sub(sess.lastArrival)
+			violated = gap < shortest
+		}
+		if !violated || !s.RejectCadenceViolation {
+			sess.lastArrival = now
+		}
+	}
+	s.mu.Unlock()
+	if !violated {
+		return true
+	}
+	atomic.AddUint64(&s.cadenceViolations, 1)
+	s.metrics().IncCounter(MetricCadenceViolations)
+	if s.OnCadenceViolation != nil {
+		s.OnCadenceViolation(identifier, advertised, gap)
+	}
+	if s.RejectCadenceViolation {
+		writeRetryAfter(w, "beat faster than advertised interval", http.StatusTooManyRequests, shortest-gap)
+		return false
+	}
+	return true
+}
+
+// CadenceViolations return the number of beats arrived faster than the advertised interval
+func (s *Server) CadenceViolations() uint64 {
+	return atomic.LoadUint64(&s.cadenceViolations)
+}
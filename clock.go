@@ -0,0 +1,40 @@
+package heartbeat
+
+import (
+	"time"
+
+	"github.com/codeskyblue/safetime"
+)
+
+/*
+Clock ->
+
+Server.Clock and Server.NewTimer are the time of the sessions: Clock the current time of timestamps
+and session bookkeeping (deadlines, lifetimes, intervals, cadence, events, reconnect windows, roster,
+quotas, credits and throttles, DiagnoseSessions), NewTimer the timers sessions expire with.
+Both default to the real clock. Set them together to a fake clock to drive expiry from a test
+without sleeping, TestExpiryAtScale does it with a million sessions.
+Request latencies and metrics always use the real clock.
+*/
+
+// Timer is the expiry timer of one session, see Server.NewTimer
+type Timer interface {
+	C() <-chan time.Time
+	Reset(d time.Duration) bool
+	Stop() bool
+}
+
+type realTimer struct {
+	*safetime.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+func (s *Server) newTimer(d time.Duration) Timer {
+	if s.NewTimer != nil {
+		return s.NewTimer(d)
+	}
+	return realTimer{safetime.NewTimer(d)}
+}
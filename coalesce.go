@@ -0,0 +1,58 @@
+package heartbeat
+
+import "time"
+
+/*
+Disconnect coalescing, with Server.CoalesceDisconnect ->
+
+When a session end, OnDisconnect, OnLastWill and OnInterval are held for CoalesceDisconnect
+instead of being called at once. If the identifier connect again within that window,
+the held callbacks are dropped and so is the OnConnect (or OnReconnect) of the new session:
+the callbacks see one continuous session, which keep the ConnectedAt and interval start of the first.
+Past the window the held callbacks are called, from a timer goroutine, holding the server lock as usual.
+
+Only callbacks are coalesced: events (Events, Watch), metrics and SessionInfo report the
+disconnect and the connect as they happened. Sessions ended by a takeover (ReasonSuperseded)
+are never coalesced, the new device is a real change. A disconnect is thus reported
+up to CoalesceDisconnect late, pick a window around the reconnect time of the clients, a few seconds.
+*/
+
+// heldDisconnect is a disconnect whose callbacks wait for the coalescing window
+type heldDisconnect struct {
+	sess   *Session
+	notify func()
+}
+
+// notifyDisconnect call the disconnect callbacks of sess, or hold them with CoalesceDisconnect, must hold s.mu
+func (s *Server) notifyDisconnect(sess *Session, notify func()) {
+	if s.CoalesceDisconnect <= 0 || sess.reason == ReasonSuperseded {
+		notify()
+		return
+	}
+	if s.held == nil {
+		s.held = make(map[string]*heldDisconnect)
+	}
+	h := &heldDisconnect{sess: sess, notify: notify}
+	if prev, ok := s.held[sess.identifier]; ok {
+		prev.notify() // the identifier flapped twice within the window, report the first one now
+	}
+	s.held[sess.identifier] = h
+	time.AfterFunc(s.CoalesceDisconnect, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.held[sess.identifier] == h {
+			delete(s.held, sess.identifier)
+			h.notify()
+		}
+	})
+}
+
+// coalesce cancel and return the held disconnect of identifier, connecting again.
+// Nil when there was none, the connect callbacks are then due, must hold s.mu
+func (s *Server) coalesce(identifier string) *heldDisconnect {
+	h, ok := s.held[identifier]
+	if ok {
+		delete(s.held, identifier)
+	}
+	return h
+}
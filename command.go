@@ -0,0 +1,181 @@
+package heartbeat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+/*
+Commands are queued on the server by SendCommand and sent (signed) with every reply
+to that identifier, as reply extra cmd={id} {payload}, until the client acknowledge them.
+The client keep received commands in its inbox (Commands) until the app call Ack,
+acks are sent with the next beat as request extra ack={id}, then the server drop the commands.
+
+Delivery is at-least-once: a command is sent again until its ack arrive,
+duplicates of commands in the inbox or already acked are discarded by the client.
+*/
+
+const (
+	extraCommand       = "cmd"
+	fieldAck           = "ack"
+	maxPendingCommands = 64
+	maxCommandPayload  = 1024
+)
+
+// Command is a message from the server to one client
+type Command struct {
+	ID      string
+	Payload string
+}
+
+// SendCommand queue payload for identifier, delivered with the next replies until acknowledged.
+// The identifier does not need to be online.
+func (s *Server) SendCommand(identifier, payload string) (id string, err error) {
+	if len(payload) > maxCommandPayload {
+		return "", errors.Errorf("command payload over %d bytes", maxCommandPayload)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.checkBudget() {
+		return "", errors.New("server over memory budget")
+	}
+	return s.queueCommand(identifier, payload)
+}
+
+// queueCommand add a command for identifier, must hold s.mu
+func (s *Server) queueCommand(identifier, payload string) (id string, err error) {
+	if limit := s.commandLimit(identifier); len(s.commands[identifier]) >= limit {
+		if limit == 0 {
+			return "", errors.Errorf("%s is throttled without commands", identifier)
+		}
+		return "", errors.Errorf("%d commands pending for %s", limit, identifier)
+	}
+	b := make([]byte, 8)
+	if _, err = rand.Read(b); err != nil {
+		return "", err
+	}
+	id = hex.EncodeToString(b)
+	if s.commands == nil {
+		s.commands = make(map[string][]Command)
+	}
+	s.commands[identifier] = append(s.commands[identifier], Command{ID: id, Payload: payload})
+	return id, nil
+}
+
+// PendingCommands return the commands of identifier not acknowledged yet
+func (s *Server) PendingCommands(identifier string) []Command {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Command(nil), s.commands[identifier]...)
+}
+
+// commandExtra add the pending commands of identifier to the reply
+func (s *Server) commandExtra(identifier string, extra url.Values) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// held while throttled with NoCommands
+	if t := s.throttled(identifier, s.now()); t == nil || !t.policy.NoCommands {
+		for _, cmd := range s.commands[identifier] {
+			extra[extraCommand] = append(extra[extraCommand], cmd.ID+" "+cmd.Payload)
+		}
+	}
+	s.migrateExtra(identifier, extra)
+}
+
+// ackCommands drop the commands acknowledged by identifier
+func (s *Server) ackCommands(identifier string, acks []string) {
+	if len(acks) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	acked := make(map[string]bool, len(acks))
+	for _, id := range acks {
+		acked[id] = true
+	}
+	s.noteMigrateAck(identifier, acked)
+	s.dropCommands(identifier, acked)
+}
+
+// dropCommands remove the commands of identifier whose id is in ids, must hold s.mu
+func (s *Server) dropCommands(identifier string, ids map[string]bool) {
+	pending := s.commands[identifier][:0]
+	for _, cmd := range s.commands[identifier] {
+		if !ids[cmd.ID] {
+			pending = append(pending, cmd)
+		}
+	}
+	if len(pending) == 0 {
+		delete(s.commands, identifier)
+	} else {
+		s.commands[identifier] = pending
+	}
+}
+
+// receiveCommands add new commands of a reply to the inbox, must hold c.mu
+func (c *Client) receiveCommands(values []string) {
+	sent := make(map[string]bool, len(values))
+	for _, v := range values {
+		parts := strings.SplitN(v, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		cmd := Command{ID: parts[0], Payload: parts[1]}
+		sent[cmd.ID] = true
+		if c.acked[cmd.ID] || c.hasCommand(cmd.ID) || c.receiveMigrate(cmd) {
+			continue
+		}
+		c.inbox = append(c.inbox, cmd)
+	}
+	// the server stopped sending them, acks arrived
+	for id := range c.acked {
+		if !sent[id] {
+			delete(c.acked, id)
+		}
+	}
+}
+
+func (c *Client) hasCommand(id string) bool {
+	for _, cmd := range c.inbox {
+		if cmd.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Commands return the received commands not acknowledged yet, in the order received
+func (c *Client) Commands() []Command {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Command(nil), c.inbox...)
+}
+
+// Ack remove the command from the inbox, the server is told with the next beat
+func (c *Client) Ack(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, cmd := range c.inbox {
+		if cmd.ID == id {
+			c.inbox = append(c.inbox[:i], c.inbox[i+1:]...)
+			if c.acked == nil {
+				c.acked = make(map[string]bool)
+			}
+			c.acked[id] = true
+			return
+		}
+	}
+}
+
+// pendingAcks return ids to acknowledge in the next beat, must hold c.mu
+func (c *Client) pendingAcks() []string {
+	ids := make([]string, 0, len(c.acked))
+	for id := range c.acked {
+		ids = append(ids, id)
+	}
+	return ids
+}
@@ -0,0 +1,53 @@
+package heartbeat
+
+import "time"
+
+// config return secret and timeout together, a request use one snapshot of both
+func (s *Server) config() (secret string, timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.secret, s.hbTimeout
+}
+
+// Reconfigure change secret and timeout atomically, no beat see one updated without the other.
+// Beats signed with the old secret are rejected from now on, clients must switch too.
+//
+// Existing sessions keep their timer and timeout unless rearm is true,
+// then all of them are armed again with the new timeout (or TimeoutForIdentifier) from now.
+// New sessions always use the new timeout.
+func (s *Server) Reconfigure(secret string, timeout time.Duration, rearm bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.secret = secret
+	s.hbTimeout = timeout
+	if !rearm {
+		return
+	}
+	for _, sess := range s.sessions {
+		sess.timeout = s.timeoutFor(sess.identifier)
+		s.rearm(sess, sess.timeout)
+	}
+}
+
+// RefreshTimeouts evaluate TimeoutForIdentifier again for every session, e.g. after the policy changed.
+// Sessions whose timeout changed are armed again with it from now, the others keep their timer.
+func (s *Server) RefreshTimeouts() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sess := range s.sessions {
+		if timeout := s.timeoutFor(sess.identifier); timeout != sess.timeout {
+			sess.timeout = timeout
+			s.rearm(sess, timeout)
+		}
+	}
+}
+
+// timeoutFor return the timeout of the sessions of identifier, must hold s.mu
+func (s *Server) timeoutFor(identifier string) time.Duration {
+	if s.TimeoutForIdentifier != nil {
+		if timeout := s.TimeoutForIdentifier(identifier); timeout > 0 {
+			return timeout
+		}
+	}
+	return s.hbTimeout
+}
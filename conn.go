@@ -0,0 +1,67 @@
+package heartbeat
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+type connKey struct{}
+
+// ConnContext is for http.Server.ConnContext, it let DisconnectOnClose know the connection of each beat.
+//
+//	srv := &http.Server{Handler: hbs, ConnContext: hbs.ConnContext, ConnState: hbs.ConnState}
+func (s *Server) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// ConnState is for http.Server.ConnState, with DisconnectOnClose it disconnect
+// the sessions whose last beat came on a closed (or hijacked) connection, with ReasonConnectionClosed.
+//
+// Only use it for clients keeping one connection open between beats,
+// an idle timeout of the client or server (http.Server.IdleTimeout) closing the connection
+// disconnect the session too. Clients behind a proxy sharing one connection are all disconnected together.
+func (s *Server) ConnState(c net.Conn, state http.ConnState) {
+	if !s.DisconnectOnClose || (state != http.StateClosed && state != http.StateHijacked) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sess := range s.conns[c] {
+		// removeSession unbind, and a timeout racing with the close find the session already gone
+		s.disconnect(sess, ReasonConnectionClosed)
+	}
+	delete(s.conns, c)
+}
+
+// bindConn remember the connection req came on, must hold s.mu
+func (s *Server) bindConn(sess *Session, req *http.Request) {
+	if !s.DisconnectOnClose {
+		return
+	}
+	c, ok := req.Context().Value(connKey{}).(net.Conn)
+	if !ok || c == sess.conn {
+		return
+	}
+	s.unbindConn(sess)
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]map[*Session]bool)
+	}
+	if s.conns[c] == nil {
+		s.conns[c] = make(map[*Session]bool)
+	}
+	s.conns[c][sess] = true
+	sess.conn = c
+}
+
+// unbindConn forget the connection of sess, must hold s.mu
+func (s *Server) unbindConn(sess *Session) {
+	if sess.conn == nil {
+		return
+	}
+	delete(s.conns[sess.conn], sess)
+	if len(s.conns[sess.conn]) == 0 {
+		delete(s.conns, sess.conn)
+	}
+	sess.conn = nil
+}
@@ -0,0 +1,72 @@
+package heartbeat
+
+import "time"
+
+/*
+Beat credits, with CreditRate > 0 ->
+
+Every identifier has a token bucket of CreditBurst credits (default 10), refilled at CreditRate
+credits per second. Every request spend one credit, a request without credit get 429.
+A client beating slower than CreditRate keep its bucket full, a client beating too fast
+drain it and get throttled until it slow down.
+
+Credits also give priority: when the group rate of GroupQuota is exceeded,
+identifiers with at least half their burst left are still admitted, only the ones
+spending their credits get 429.
+*/
+
+const defaultCreditBurst = 10
+
+func (s *Server) creditBurst() int {
+	if s.CreditBurst <= 0 {
+		return defaultCreditBurst
+	}
+	return s.CreditBurst
+}
+
+// spendCredit take one credit of identifier, report whether it had one
+// and whether it is well behaved (half its burst left), must hold s.mu
+func (s *Server) spendCredit(identifier string, now time.Time) (ok, priority bool) {
+	if s.CreditRate <= 0 {
+		return true, false
+	}
+	if s.credits == nil {
+		s.credits = make(map[string]*tokenBucket)
+	}
+	b, found := s.credits[identifier]
+	if !found {
+		s.pruneCredits(now)
+		b = &tokenBucket{}
+		s.credits[identifier] = b
+	}
+	burst := s.creditBurst()
+	if !b.take(now, s.CreditRate, burst) {
+		return false, false
+	}
+	return true, b.tokens >= float64(burst)/2
+}
+
+// pruneCredits forget the buckets full again, they are the same as a new one, must hold s.mu
+func (s *Server) pruneCredits(now time.Time) {
+	if len(s.credits) < 2*len(s.sessions)+1024 {
+		return
+	}
+	burst := float64(s.creditBurst())
+	for id, b := range s.credits {
+		if b.peek(now, s.CreditRate, int(burst)) >= burst {
+			delete(s.credits, id)
+		}
+	}
+}
+
+// remainingCredits return the credits identifier has now, must hold s.mu
+func (s *Server) remainingCredits(identifier string, now time.Time) float64 {
+	if s.CreditRate <= 0 {
+		return 0
+	}
+	b, ok := s.credits[identifier]
+	if !ok {
+		return float64(s.creditBurst())
+	}
+	return b.peek(now, s.CreditRate, s.creditBurst())
+}
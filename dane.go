@@ -0,0 +1,158 @@
+package heartbeat
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// TLSA is one DNS TLSA record (RFC 6698)
+type TLSA struct {
+	Usage        uint8 // 0 PKIX-TA, 1 PKIX-EE, 2 DANE-TA, 3 DANE-EE
+	Selector     uint8 // 0 full certificate, 1 SubjectPublicKeyInfo
+	MatchingType uint8 // 0 exact, 1 SHA-256, 2 SHA-512
+	Data         []byte
+}
+
+// TLSALookupFunc return the TLSA records of _{port}._tcp.{host}.
+// It must only return records validated by DNSSEC, otherwise DANE give no security at all.
+// The standard library resolver does not validate DNSSEC, use a validating resolver library.
+type TLSALookupFunc func(ctx context.Context, host, port string) ([]TLSA, error)
+
+// daneTransport clone base (or http.DefaultTransport) and verify server certificates with lookup.
+// When no TLSA record exist, the system trust store is used as usual.
+func daneTransport(base http.RoundTripper, lookup TLSALookupFunc) (*http.Transport, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	bt, ok := base.(*http.Transport)
+	if !ok {
+		return nil, errors.New("dane: Transport must be *http.Transport")
+	}
+	t := bt.Clone()
+	tlsConfig := t.TLSClientConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	dial := t.DialContext // keep custom dialers, e.g. a SOCKS5 proxy
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	t.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		records, err := lookup(ctx, host, port)
+		if err != nil {
+			return nil, errors.Wrap(err, "dane: lookup tlsa")
+		}
+		cfg := tlsConfig.Clone()
+		cfg.ServerName = host
+		cfg.InsecureSkipVerify = true // verified below
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyDANE(cs, cfg.RootCAs, records)
+		}
+		raw, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		conn := tls.Client(raw, cfg)
+		if err := conn.HandshakeContext(ctx); err != nil {
+			raw.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	return t, nil
+}
+
+// verifyDANE accept the connection if any TLSA record match, without records fallback to PKIX
+func verifyDANE(cs tls.ConnectionState, roots *x509.CertPool, records []TLSA) error {
+	certs := cs.PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("dane: no peer certificate")
+	}
+	pkix := func() ([][]*x509.Certificate, error) {
+		inter := x509.NewCertPool()
+		for _, c := range certs[1:] {
+			inter.AddCert(c)
+		}
+		return certs[0].Verify(x509.VerifyOptions{DNSName: cs.ServerName, Roots: roots, Intermediates: inter})
+	}
+	if len(records) == 0 {
+		_, err := pkix()
+		return err
+	}
+	for _, rr := range records {
+		switch rr.Usage {
+		case 0, 1:
+			chains, err := pkix()
+			if err != nil {
+				continue
+			}
+			for _, chain := range chains {
+				candidates := chain
+				if rr.Usage == 1 {
+					candidates = chain[:1]
+				}
+				for _, c := range candidates {
+					if rr.matches(c) {
+						return nil
+					}
+				}
+			}
+		case 2:
+			for _, c := range certs[1:] {
+				if !rr.matches(c) {
+					continue
+				}
+				anchor := x509.NewCertPool()
+				anchor.AddCert(c)
+				inter := x509.NewCertPool()
+				for _, ic := range certs[1:] {
+					inter.AddCert(ic)
+				}
+				if _, err := certs[0].Verify(x509.VerifyOptions{DNSName: cs.ServerName, Roots: anchor, Intermediates: inter}); err == nil {
+					return nil
+				}
+			}
+		case 3:
+			if rr.matches(certs[0]) {
+				return nil
+			}
+		}
+	}
+	return errors.New("dane: no TLSA record match the server certificate")
+}
+
+func (rr TLSA) matches(cert *x509.Certificate) bool {
+	var data []byte
+	switch rr.Selector {
+	case 0:
+		data = cert.Raw
+	case 1:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+	switch rr.MatchingType {
+	case 0:
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	default:
+		return false
+	}
+	return bytes.Equal(data, rr.Data)
+}
@@ -0,0 +1,106 @@
+package heartbeat
+
+import (
+	"sort"
+	"time"
+)
+
+// TimerDiagnostic is the timer bookkeeping of one session, for troubleshooting only.
+// Fields follow the internals of the session timer and may change between versions.
+type TimerDiagnostic struct {
+	Identifier string
+	ArmedAt    time.Time     // when the timer was last armed, by connect or a beat
+	ArmedFor   time.Duration // timeout it was armed with
+	Deadline   time.Time     // when the session time out if no beat come
+	Remaining  time.Duration // Deadline - now, or the timeout kept while expiry is frozen
+	Stopped    bool          // the last signal stopped the timer (FreezeExpiry)
+	Frozen     bool
+	Resets     uint64 // signals sent to the timer goroutine
+	Pending    bool   // a signal is not yet taken by the timer goroutine
+	Queued     int    // signals waiting, at most Buffer
+	HighWater  int    // most signals ever waiting
+	Coalesced  uint64 // signals replaced before the timer goroutine took them
+	Buffer     int
+	LastBeat   time.Time
+	Beats      int64
+}
+
+// DiagnoseSessions dump the timer state of every session sorted by identifier, taken under the server lock.
+// A session whose Remaining is negative while not Frozen is stuck: its timer fired, or should have,
+// but it was not removed. It is a diagnostic API, use SessionInfo for everything else.
+func (s *Server) DiagnoseSessions() []TimerDiagnostic {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	diags := make([]TimerDiagnostic, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		d := TimerDiagnostic{
+			Identifier: sess.identifier,
+			ArmedAt:    sess.armedAt,
+			ArmedFor:   sess.armedFor,
+			Deadline:   sess.deadline,
+			Remaining:  sess.deadline.Sub(now),
+			Stopped:    sess.stopped,
+			Frozen:     s.frozen,
+			Resets:     sess.resets,
+			Pending:    len(sess.recvC) > 0,
+			Queued:     len(sess.recvC),
+			HighWater:  sess.highWater,
+			Coalesced:  sess.coalesced,
+			Buffer:     cap(sess.recvC),
+			LastBeat:   sess.arrivals.last,
+		}
+		if !sess.arrivals.last.IsZero() {
+			d.Beats = sess.arrivals.count + 1 // count is the gaps between beats
+		}
+		if s.frozen {
+			d.Remaining = sess.remaining
+		}
+		diags = append(diags, d)
+	}
+	sort.Slice(diags, func(i, j int) bool { return diags[i].Identifier < diags[j].Identifier })
+	return diags
+}
+
+// SignalStats summarize the beat signals of the online sessions to their timer goroutine.
+//
+// Every beat send the new timeout to the timer goroutine of its session over a channel of
+// Server.SignalBuffer entries. When the channel is full the oldest waiting signal is replaced by the new one,
+// counted in Coalesced: no beat is lost, the timer only need the last timeout, so coalescing is
+// harmless and a buffer of 1 is enough for correctness. A larger buffer let a busy timer goroutine
+// fall further behind before coalescing, each entry cost 8 bytes per session, and the goroutine then
+// reset its timer once per queued signal instead of once. A HighWater at the Buffer with many Coalesced
+// mean the timer goroutines are starved of CPU, not that the buffer is too small.
+type SignalStats struct {
+	Sessions  int
+	Signals   uint64 // sent, sum of TimerDiagnostic.Resets
+	Coalesced uint64
+	Pending   int // sessions with a signal waiting
+	HighWater int // highest HighWater of a session
+	Buffer    int // Server.SignalBuffer for new sessions
+}
+
+// SignalStats return the signal statistics of the online sessions
+func (s *Server) SignalStats() SignalStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := SignalStats{Sessions: len(s.sessions), Buffer: s.signalBuffer()}
+	for _, sess := range s.sessions {
+		st.Signals += sess.resets
+		st.Coalesced += sess.coalesced
+		if len(sess.recvC) > 0 {
+			st.Pending++
+		}
+		if sess.highWater > st.HighWater {
+			st.HighWater = sess.highWater
+		}
+	}
+	return st
+}
+
+func (s *Server) signalBuffer() int {
+	if s.SignalBuffer > 0 {
+		return s.SignalBuffer
+	}
+	return 1
+}
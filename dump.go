@@ -0,0 +1,94 @@
+package heartbeat
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+Session dump, for post-mortem debugging ->
+
+DumpSessions write the sessions to a file every interval, in the format of MarshalSessions,
+so after a crash the file tell who was connected at most one interval before. It is a forensic
+record, nothing read it back, feed it to UnmarshalSessions by hand if wanted.
+
+  - the file is replaced atomically: written to a temporary file of the same directory, synced, renamed,
+    a crash during a write leave the previous dump intact
+  - the server lock is only held to copy the sessions, encoding and I/O run outside of it
+  - a dump taking longer than interval/dumpBudget delay the next one to dumpBudget times its duration,
+    so with many sessions or a slow disk dumps take at most about 1/dumpBudget of the time
+*/
+
+const dumpBudget = 10
+
+// DumpSessions write the sessions to path now, then every interval until stop is called.
+// The first write error is returned, later ones are logged and the next dump tried.
+func (s *Server) DumpSessions(path string, interval time.Duration) (stop func(), err error) {
+	if interval <= 0 {
+		return nil, errors.New("dump interval must be positive")
+	}
+	took, err := s.dumpSessions(path)
+	if err != nil {
+		return nil, err
+	}
+	quit := make(chan struct{})
+	go func(took time.Duration) {
+		for {
+			wait := interval
+			if budgeted := took * dumpBudget; budgeted > wait {
+				wait = budgeted
+			}
+			select {
+			case <-quit:
+				return
+			case <-time.After(wait):
+			}
+			var err error
+			if took, err = s.dumpSessions(path); err != nil {
+				log.Printf("heartbeat: dump sessions: %v", err)
+			}
+		}
+	}(took)
+	var once sync.Once
+	return func() { once.Do(func() { close(quit) }) }, nil
+}
+
+// dumpSessions replace path with the current sessions, return how long it took
+func (s *Server) dumpSessions(path string) (time.Duration, error) {
+	start := time.Now()
+	s.mu.Lock()
+	states := s.snapshot()
+	s.mu.Unlock()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return 0, errors.Wrap(err, "create dump")
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	w := bufio.NewWriter(tmp)
+	err = json.NewEncoder(w).Encode(states)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "write dump")
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return 0, errors.Wrap(err, "rename dump")
+	}
+	return time.Since(start), nil
+}
@@ -0,0 +1,174 @@
+package heartbeat
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+/*
+Ed25519 mode -> (instead of the shared secret HMAC)
+
+	Query: signature, hex Ed25519 signature of "{timestamp}:{identifier}:{extra}:beat"
+	       by Client.SigningKey, replacing messageMAC and extraMAC. extra is the request extra, may be empty.
+
+The server verify it against the public key Server.PublicKeyFunc return for identifier.
+That is the key management hook: keys can come from a map, a database or a directory.
+
+PublicKeyFunc also decide which identifiers the shared secret still work for, HMAC and AuthFunc
+beats included, so a leaked secret can not forge beats of keyed clients:
+
+	PublicKeyFunc return     signature beat          HMAC or AuthFunc beat
+	key, nil                 verified with key       403 "signature required"
+	nil, ErrKeyRevoked       403 "key revoked"       403 "key revoked"
+	nil, nil                 400 "signature wrong"   accepted, the identifier is not keyed
+	nil, other error         500                     500
+
+Revoke a client by returning ErrKeyRevoked, returning nil would downgrade it to the secret.
+With RequireSignature every identifier is keyed: HMAC and AuthFunc beats are refused,
+PublicKeyFunc is not even asked. Without it, PublicKeyFunc is called for every HMAC beat too.
+
+Replies are signed with Server.SigningKey when set, the client check them with Client.ServerKey,
+same lines as the HMAC reply. Without a server key, replies keep the HMAC of the secret.
+*/
+
+const fieldSignature = "signature"
+
+// ErrKeyRevoked is returned by PublicKeyFunc for a client whose key was revoked,
+// its beats are then refused whatever they are signed with
+var ErrKeyRevoked = errors.New("key revoked")
+
+// replySigner sign the reply lines on server and check them on client
+type replySigner interface {
+	signTimestamp(timestamp string) string
+	signExtra(timestamp, extra string) string
+	verifyTimestamp(timestamp, sig string) bool
+	verifyExtra(timestamp, extra, sig string) bool
+}
+
+// hmacSigner is the default signer, the shared secret
+type hmacSigner string
+
+func (secret hmacSigner) signTimestamp(timestamp string) string {
+	return hashTimestamp(timestamp, string(secret))
+}
+
+func (secret hmacSigner) signExtra(timestamp, extra string) string {
+	return hashExtra(timestamp, extra, string(secret))
+}
+
+func (secret hmacSigner) verifyTimestamp(timestamp, sig string) bool {
+	return secret.signTimestamp(timestamp) == sig
+}
+
+func (secret hmacSigner) verifyExtra(timestamp, extra, sig string) bool {
+	return secret.signExtra(timestamp, extra) == sig
+}
+
+// ed25519Signer sign with private on server, verify with public on client
+type ed25519Signer struct {
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+func (k ed25519Signer) signTimestamp(timestamp string) string {
+	return hex.EncodeToString(ed25519.Sign(k.private, []byte(timestamp+":timestamp")))
+}
+
+func (k ed25519Signer) signExtra(timestamp, extra string) string {
+	return hex.EncodeToString(ed25519.Sign(k.private, []byte(fmt.Sprintf("%s:%s:extra", timestamp, extra))))
+}
+
+func (k ed25519Signer) verifyTimestamp(timestamp, sig string) bool {
+	return verifyEd25519(k.public, timestamp+":timestamp", sig)
+}
+
+func (k ed25519Signer) verifyExtra(timestamp, extra, sig string) bool {
+	return verifyEd25519(k.public, fmt.Sprintf("%s:%s:extra", timestamp, extra), sig)
+}
+
+func verifyEd25519(public ed25519.PublicKey, message, sig string) bool {
+	raw, err := hex.DecodeString(sig)
+	if err != nil || len(public) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(public, []byte(message), raw)
+}
+
+func beatMessage(timestamp, identifier, extra string) string {
+	return fmt.Sprintf("%s:%s:%s:beat", timestamp, identifier, extra)
+}
+
+// signBeat set the signature of the client request
+func (c *Client) signBeat(form url.Values, timestamp, extra string) {
+	sig := ed25519.Sign(c.SigningKey, []byte(beatMessage(timestamp, c.Identifier, extra)))
+	form.Set(fieldSignature, hex.EncodeToString(sig))
+}
+
+// replySigner return how the client check replies, key is the HMAC key of the request
+func (c *Client) replySigner(key string) replySigner {
+	if c.ServerKey != nil {
+		return ed25519Signer{public: c.ServerKey}
+	}
+	return hmacSigner(key)
+}
+
+// verifySignature check an Ed25519 request and return its request extra
+func (s *Server) verifySignature(w http.ResponseWriter, r *http.Request, timestamp, identifier string) (url.Values, bool) {
+	public, err := s.PublicKeyFunc(identifier)
+	if errors.Cause(err) == ErrKeyRevoked {
+		http.Error(w, "key revoked", http.StatusForbidden)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "public key: "+err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	encoded := r.FormValue("extra")
+	if public == nil || !verifyEd25519(public, beatMessage(timestamp, identifier, encoded), r.FormValue(fieldSignature)) {
+		http.Error(w, "signature wrong", http.StatusBadRequest)
+		return nil, false
+	}
+	extra, err := url.ParseQuery(encoded)
+	if err != nil {
+		http.Error(w, "parse extra", http.StatusBadRequest)
+		return nil, false
+	}
+	return extra, true
+}
+
+// checkUnsigned refuse beats not signed with Ed25519 for identifiers PublicKeyFunc manage, see ed25519.go
+func (s *Server) checkUnsigned(w http.ResponseWriter, identifier string) bool {
+	if s.PublicKeyFunc == nil {
+		return true
+	}
+	if s.RequireSignature {
+		http.Error(w, "signature required", http.StatusForbidden)
+		return false
+	}
+	public, err := s.PublicKeyFunc(identifier)
+	switch {
+	case errors.Cause(err) == ErrKeyRevoked:
+		http.Error(w, "key revoked", http.StatusForbidden)
+		return false
+	case err != nil:
+		http.Error(w, "public key: "+err.Error(), http.StatusInternalServerError)
+		return false
+	case public != nil:
+		http.Error(w, "signature required", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// serverSigner return how the reply to a request is signed
+func (s *Server) serverSigner(secret string, signed bool) replySigner {
+	if signed && s.SigningKey != nil {
+		return ed25519Signer{private: s.SigningKey}
+	}
+	return hmacSigner(secret)
+}
@@ -0,0 +1,58 @@
+package heartbeat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+/*
+Server epoch, with Server.SendEpoch ->
+
+	Reply extra: epoch={unix nanoseconds}.{8 random bytes in hex}, signed like every directive
+
+The epoch is generated once per Server, on its first reply (or Epoch call), not once per process:
+two Servers of one process have different epochs, and a Server replaced by NewServer, e.g. on a
+config reload, start a new one although the process did not restart. The first part increase with
+every new Server (as long as the clock does), the random part tell apart Servers started at the same time.
+A client seeing the epoch change between two beats switched instance, or its instance restarted
+or replaced its Server, Client.OnEpochChange is then called. Handover and a shared secret do not hide it.
+*/
+
+const extraEpoch = "epoch"
+
+// Epoch return the epoch of s sent to clients with SendEpoch
+func (s *Server) Epoch() string {
+	s.epochOnce.Do(func() {
+		b := make([]byte, 8)
+		rand.Read(b)
+		s.epoch = strconv.FormatInt(time.Now().UnixNano(), 10) + "." + hex.EncodeToString(b)
+	})
+	return s.epoch
+}
+
+// epochExtra set the epoch directive
+func (s *Server) epochExtra(extra url.Values) {
+	if s.SendEpoch {
+		extra.Set(extraEpoch, s.Epoch())
+	}
+}
+
+// noteEpoch remember the server epoch in a reply, return the previous one if it changed, must hold c.mu
+func (c *Client) noteEpoch(extra url.Values) (old string, changed bool) {
+	epoch := extra.Get(extraEpoch)
+	if epoch == "" {
+		return "", false
+	}
+	old, c.epoch = c.epoch, epoch
+	return old, old != "" && old != epoch
+}
+
+// ServerEpoch return the epoch of the server in the last reply, empty if it does not send it
+func (c *Client) ServerEpoch() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.epoch
+}
@@ -0,0 +1,138 @@
+/*
+Package eventbus forward presence events of a heartbeat.Server to a message bus (Kafka, NATS, ...).
+
+The package does not depend on any bus client, wrap yours in a Publisher.
+Each event is published to "{TopicPrefix}{type}" (e.g. heartbeat.connect) as JSON:
+
+	{"type":"connect","identifier":"...","remoteHost":"...","time":"2006-01-02T15:04:05Z"}
+
+Disconnect events carry the reason, the span the session was online, and the last will of a timeout:
+
+	{"type":"disconnect",...,"reason":"timeout","interval":{"start":"...","end":"..."},"lastWill":"..."}
+
+Delivery is at-least-once: an event is retried with backoff until Publish succeed, so consumers
+may see duplicates. While retrying, new events wait in the Server.Events buffer and its
+OverflowPolicy decide what is dropped when the bus is down for long.
+*/
+package eventbus
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/codeskyblue/heartbeat"
+)
+
+// Publisher send payload to topic of a message bus
+type Publisher interface {
+	Publish(topic string, payload []byte) error
+}
+
+// Reconnecter is implemented by Publishers able to re-establish their connection,
+// Reconnect is called before retrying a failed Publish.
+type Reconnecter interface {
+	Reconnect() error
+}
+
+// Forwarder publish events to Publisher
+type Forwarder struct {
+	Publisher        Publisher
+	TopicPrefix      string        // default "heartbeat."
+	RetryInterval    time.Duration // first retry delay, doubled up to MaxRetryInterval, default 1s
+	MaxRetryInterval time.Duration // default 30s
+	OnError          func(error)   // called on every failed Publish or Reconnect
+}
+
+type payload struct {
+	Type       string           `json:"type"`
+	Identifier string           `json:"identifier"`
+	RemoteHost string           `json:"remoteHost"`
+	Time       time.Time        `json:"time"`
+	Reason     string           `json:"reason,omitempty"`
+	Interval   *intervalPayload `json:"interval,omitempty"`
+	LastWill   string           `json:"lastWill,omitempty"`
+}
+
+type intervalPayload struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+func newPayload(ev heartbeat.Event) payload {
+	p := payload{
+		Type:       ev.Type.String(),
+		Identifier: ev.Identifier,
+		RemoteHost: ev.RemoteHost,
+		Time:       ev.Time,
+		Reason:     string(ev.Reason),
+		LastWill:   ev.LastWill,
+	}
+	if ev.Interval != nil {
+		p.Interval = &intervalPayload{Start: ev.Interval.Start, End: ev.Interval.End}
+	}
+	return p
+}
+
+// Run forward events until ctx is done or events is closed
+func (f *Forwarder) Run(ctx context.Context, events <-chan heartbeat.Event) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if err := f.publish(ctx, ev); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// publish retry one event until it is published or ctx is done
+func (f *Forwarder) publish(ctx context.Context, ev heartbeat.Event) error {
+	prefix := f.TopicPrefix
+	if prefix == "" {
+		prefix = "heartbeat."
+	}
+	data, err := json.Marshal(newPayload(ev))
+	if err != nil {
+		return err
+	}
+	wait := f.RetryInterval
+	if wait <= 0 {
+		wait = time.Second
+	}
+	maxWait := f.MaxRetryInterval
+	if maxWait <= 0 {
+		maxWait = 30 * time.Second
+	}
+	for {
+		err := f.Publisher.Publish(prefix+ev.Type.String(), data)
+		if err == nil {
+			return nil
+		}
+		f.onError(err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > maxWait {
+			wait = maxWait
+		}
+		if r, ok := f.Publisher.(Reconnecter); ok {
+			if err := r.Reconnect(); err != nil {
+				f.onError(err)
+			}
+		}
+	}
+}
+
+func (f *Forwarder) onError(err error) {
+	if f.OnError != nil {
+		f.OnError(err)
+	}
+}
@@ -0,0 +1,123 @@
+package eventbus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codeskyblue/heartbeat"
+)
+
+// flakyPublisher fail the first failures Publish, recording the time of each attempt
+type flakyPublisher struct {
+	mu         sync.Mutex
+	failures   int
+	attempts   []time.Time
+	reconnects int
+	topics     []string
+	payloads   [][]byte
+}
+
+func (p *flakyPublisher) Publish(topic string, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.attempts = append(p.attempts, time.Now())
+	if len(p.attempts) <= p.failures {
+		return errors.New("bus down")
+	}
+	p.topics = append(p.topics, topic)
+	p.payloads = append(p.payloads, payload)
+	return nil
+}
+
+func (p *flakyPublisher) Reconnect() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reconnects++
+	return nil
+}
+
+func TestPayload(t *testing.T) {
+	pub := &flakyPublisher{}
+	f := &Forwarder{Publisher: pub}
+	start := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	events := make(chan heartbeat.Event, 1)
+	events <- heartbeat.Event{
+		Type:       heartbeat.EventDisconnect,
+		Identifier: "whoami",
+		RemoteHost: "192.0.2.1",
+		Time:       start.Add(time.Minute),
+		Reason:     heartbeat.ReasonTimeout,
+		Interval:   &heartbeat.ConnectionInterval{Identifier: "whoami", Start: start, End: start.Add(time.Minute), Reason: heartbeat.ReasonTimeout},
+		LastWill:   "bye",
+	}
+	close(events)
+	if err := f.Run(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+	if len(pub.topics) != 1 || pub.topics[0] != "heartbeat.disconnect" {
+		t.Fatalf("unexpected topics %v", pub.topics)
+	}
+	var got payload
+	if err := json.Unmarshal(pub.payloads[0], &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Reason != "timeout" || got.LastWill != "bye" || got.Interval == nil ||
+		!got.Interval.Start.Equal(start) || !got.Interval.End.Equal(start.Add(time.Minute)) {
+		t.Fatalf("unexpected payload %s", pub.payloads[0])
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	pub := &flakyPublisher{failures: 4}
+	var errs int
+	f := &Forwarder{Publisher: pub, RetryInterval: 20 * time.Millisecond, MaxRetryInterval: 40 * time.Millisecond,
+		OnError: func(error) { errs++ }}
+	events := make(chan heartbeat.Event, 1)
+	events <- heartbeat.Event{Type: heartbeat.EventConnect, Identifier: "whoami"}
+	close(events)
+	if err := f.Run(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+	if len(pub.attempts) != 5 || len(pub.payloads) != 1 || errs != 4 {
+		t.Fatalf("expect 4 failures then success, got %d attempts, %d errors", len(pub.attempts), errs)
+	}
+	if pub.reconnects != 4 {
+		t.Fatalf("expect a reconnect before each retry, got %d", pub.reconnects)
+	}
+	for i, want := range []time.Duration{20, 40, 40, 40} { // doubled, capped by MaxRetryInterval
+		want *= time.Millisecond
+		if gap := pub.attempts[i+1].Sub(pub.attempts[i]); gap < want || gap > want+50*time.Millisecond {
+			t.Fatalf("retry %d: expect a wait of %v, got %v", i+1, want, gap)
+		}
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	pub := &flakyPublisher{failures: 1 << 30}
+	f := &Forwarder{Publisher: pub, RetryInterval: time.Hour}
+	events := make(chan heartbeat.Event, 1)
+	events <- heartbeat.Event{Type: heartbeat.EventConnect, Identifier: "whoami"}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- f.Run(ctx, events) }()
+	time.Sleep(20 * time.Millisecond) // the event is retrying
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("expect context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run should return once ctx is done")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := f.Run(ctx, make(chan heartbeat.Event)); err != context.Canceled {
+		t.Fatalf("expect an idle Run to return on cancel, got %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package heartbeat
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// EventType is the kind of presence change
+type EventType int
+
+const (
+	EventConnect EventType = iota
+	EventReconnect
+	EventBeat
+	EventDisconnect
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConnect:
+		return "connect"
+	case EventReconnect:
+		return "reconnect"
+	case EventBeat:
+		return "beat"
+	case EventDisconnect:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
+// Event is a presence change of one session
+type Event struct {
+	Type       EventType
+	Identifier string
+	RemoteHost string
+	Time       time.Time
+	Reason     DisconnectReason    // only set for EventDisconnect
+	Interval   *ConnectionInterval // span the session was online, only set for EventDisconnect
+	LastWill   string              // only set for EventDisconnect of a timeout, see will.go
+}
+
+// DisconnectReason tell why a session ended
+type DisconnectReason string
+
+const (
+	ReasonTimeout          DisconnectReason = "timeout"
+	ReasonBlocked          DisconnectReason = "blocked"
+	ReasonBye              DisconnectReason = "bye"
+	ReasonConnectionClosed DisconnectReason = "connection_closed"
+	ReasonSuperseded       DisconnectReason = "superseded" // another device took over, LastConnectionWins
+)
+
+// OverflowPolicy decide what happen when the Events channel is full
+type OverflowPolicy int
+
+const (
+	// DropNewest discard the event being sent, the default
+	DropNewest OverflowPolicy = iota
+	// DropOldest discard the oldest buffered event to make room
+	DropOldest
+	// Block wait for the consumer. Events are sent holding the server lock,
+	// so a slow consumer stall all beat handling.
+	Block
+)
+
+const defaultEventBuffer = 256
+
+// Events return the channel of presence changes. Events are only produced after the first call.
+// Set EventBuffer and EventOverflow before it. With the drop policies, a slow consumer lose
+// events (counted by DroppedEvents) but never slow down the server.
+func (s *Server) Events() <-chan Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.events == nil {
+		size := s.EventBuffer
+		if size <= 0 {
+			size = defaultEventBuffer
+		}
+		s.events = make(chan Event, size)
+	}
+	return s.events
+}
+
+// DroppedEvents return the number of events discarded by the overflow policy
+func (s *Server) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&s.droppedEvents)
+}
+
+// Watch call fn for every event of identifier, in addition to the global callbacks.
+// Several watchers of one identifier are called in registration order.
+// Watchers stay registered across disconnect and reconnect until Unwatch.
+// fn is called holding the server lock like OnConnect, it must not call Server methods.
+func (s *Server) Watch(identifier string, fn func(Event)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.watchers == nil {
+		s.watchers = make(map[string][]func(Event))
+	}
+	s.watchers[identifier] = append(s.watchers[identifier], fn)
+}
+
+// Unwatch remove all watchers of identifier
+func (s *Server) Unwatch(identifier string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.watchers, identifier)
+}
+
+// emit send an event to the watchers and the Events channel if any, must hold s.mu
+func (s *Server) emit(typ EventType, sess *Session) {
+	watchers := s.watchers[sess.identifier]
+	if s.events == nil && len(watchers) == 0 {
+		return
+	}
+	ev := Event{Type: typ, Identifier: sess.identifier, RemoteHost: sess.remoteHost, Time: s.now()}
+	if typ == EventDisconnect {
+		iv := s.interval(sess)
+		ev.Reason, ev.Interval, ev.LastWill = sess.reason, &iv, lastWill(sess)
+	}
+	for _, fn := range watchers {
+		fn(ev)
+	}
+	if s.events == nil {
+		return
+	}
+	switch s.EventOverflow {
+	case Block:
+		s.events <- ev
+		return
+	case DropOldest:
+		for {
+			select {
+			case s.events <- ev:
+				return
+			default:
+			}
+			select {
+			case <-s.events:
+				atomic.AddUint64(&s.droppedEvents, 1)
+				s.metrics().IncCounter(MetricDroppedEvents)
+			default:
+			}
+		}
+	default:
+		select {
+		case s.events <- ev:
+		default:
+			atomic.AddUint64(&s.droppedEvents, 1)
+			s.metrics().IncCounter(MetricDroppedEvents)
+		}
+	}
+}
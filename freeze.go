@@ -0,0 +1,56 @@
+package heartbeat
+
+import "time"
+
+// FreezeExpiry stop all session timers, no session time out until UnfreezeExpiry.
+// Presence is frozen: beats are still accepted and new clients still connect,
+// but a client going silent stay online. Explicit disconnects (Block, Bye) still happen.
+func (s *Server) FreezeExpiry() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.frozen {
+		return
+	}
+	s.frozen = true
+	now := s.now()
+	for _, sess := range s.sessions {
+		sess.remaining = sess.deadline.Sub(now)
+		sess.signal(now, 0)
+	}
+}
+
+// UnfreezeExpiry arm the session timers again. The time spent frozen is not counted:
+// a session get back the timeout it had left at FreezeExpiry,
+// or its full timeout if it beat while frozen.
+func (s *Server) UnfreezeExpiry() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.frozen {
+		return
+	}
+	s.frozen = false
+	now := s.now()
+	for _, sess := range s.sessions {
+		d := sess.remaining
+		if d <= 0 {
+			d = time.Millisecond // already expired when frozen
+		}
+		sess.signal(now, d)
+	}
+}
+
+// ExpiryFrozen report whether FreezeExpiry is in effect
+func (s *Server) ExpiryFrozen() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.frozen
+}
+
+// rearm reset the timer of sess to d, or only remember d while frozen, must hold s.mu
+func (s *Server) rearm(sess *Session, d time.Duration) {
+	if s.frozen {
+		sess.remaining = d
+		return
+	}
+	sess.signal(s.now(), d)
+}
@@ -0,0 +1,91 @@
+package heartbeat
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+/*
+Gap report, with Client.ReportGaps ->
+
+	Request extra: gap={from unix ms}-{to unix ms}, repeated, signed with the request extra
+
+from is the first failed beat, to the first request succeeding again. Gaps are sent with every
+timestamped beat until one succeeds, then forgotten, so a gap may be reported twice when a reply is lost.
+The client keep at most maxGaps gaps, dropping the oldest, and only in memory:
+gaps of a process which restarted are lost.
+The server pass them to OnClientGap, e.g. to fix a presence history.
+*/
+
+const (
+	fieldGap = "gap"
+	maxGaps  = 16
+)
+
+type gap struct {
+	from, to time.Time
+}
+
+// noteFailure open a gap at the first failed beat, must hold c.mu
+func (c *Client) noteFailure(now time.Time) {
+	if c.ReportGaps && c.gapStart.IsZero() {
+		c.gapStart = now
+	}
+}
+
+// noteSuccess close the open gap, and forget the gaps the server received, must hold c.mu
+func (c *Client) noteSuccess(now time.Time, timestamped bool) {
+	if timestamped {
+		c.gaps = c.gaps[c.gapsSent:]
+		c.gapsSent = 0
+	}
+	if c.gapStart.IsZero() {
+		return
+	}
+	c.gaps = append(c.gaps, gap{from: c.gapStart, to: now})
+	if len(c.gaps) > maxGaps {
+		c.gaps = c.gaps[len(c.gaps)-maxGaps:]
+		c.gapsSent = 0
+	}
+	c.gapStart = time.Time{}
+}
+
+// gapExtra add the closed gaps to the request extra, must hold c.mu
+func (c *Client) gapExtra(extra url.Values, timestamped bool) {
+	c.gapsSent = 0
+	if !timestamped {
+		return
+	}
+	for _, g := range c.gaps {
+		extra.Add(fieldGap, fmt.Sprintf("%d-%d", unixMillis(g.from), unixMillis(g.to)))
+	}
+	c.gapsSent = len(c.gaps)
+}
+
+// reportGaps pass the gaps a client reported to OnClientGap, must hold s.mu
+func (s *Server) reportGaps(identifier string, extra url.Values) {
+	if s.OnClientGap == nil {
+		return
+	}
+	values := extra[fieldGap]
+	if len(values) > maxGaps {
+		values = values[len(values)-maxGaps:]
+	}
+	for _, v := range values {
+		var from, to int64
+		if n, _ := fmt.Sscanf(v, "%d-%d", &from, &to); n != 2 || to < from {
+			continue
+		}
+		start, end := fromMillis(from), fromMillis(to)
+		s.callback("OnClientGap", func() { s.OnClientGap(identifier, start, end) })
+	}
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
@@ -0,0 +1,182 @@
+package heartbeat
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+Handover move the in-memory sessions of a draining server to its replacement.
+
+	POST {target}
+	Header: X-Heartbeat-Timestamp: {unix seconds}
+	Header: X-Heartbeat-Signature: hmac("{timestamp}:{body}:handover")
+	Body: JSON from MarshalSessions
+
+The source stop accepting beats (503) once Handover begins, so clients retry and reach the target.
+Beats already accepted but not yet recorded are dropped, the exported remaining timeout covers them.
+When the target accepts the sessions, the source forget them without calling OnDisconnect.
+When it fails, the source resume accepting beats and keep its sessions.
+*/
+
+// SessionState is the exported state of one session
+type SessionState struct {
+	Identifier  string        `json:"identifier"`
+	RemoteHost  string        `json:"remoteHost"`
+	ConnectedAt time.Time     `json:"connectedAt"`
+	Remaining   time.Duration `json:"remaining"` // time left before timeout
+	LastWill    string        `json:"lastWill,omitempty"`
+}
+
+func (s *Server) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining || s.stopping
+}
+
+// snapshot return state of all sessions, must hold s.mu
+func (s *Server) snapshot() []SessionState {
+	now := s.now()
+	states := make([]SessionState, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		remaining := sess.deadline.Sub(now)
+		if remaining <= 0 {
+			continue
+		}
+		states = append(states, SessionState{
+			Identifier:  sess.identifier,
+			RemoteHost:  sess.remoteHost,
+			ConnectedAt: sess.connectedAt,
+			Remaining:   remaining,
+			LastWill:    sess.will,
+		})
+	}
+	return states
+}
+
+// MarshalSessions export all sessions as JSON
+func (s *Server) MarshalSessions() ([]byte, error) {
+	s.mu.Lock()
+	states := s.snapshot()
+	s.mu.Unlock()
+	return json.Marshal(states)
+}
+
+// UnmarshalSessions import sessions exported by MarshalSessions, timers are armed with the remaining timeout.
+// OnConnect is not called for imported sessions, and identifiers already online are kept as is.
+func (s *Server) UnmarshalSessions(data []byte) error {
+	var states []SessionState
+	if err := json.Unmarshal(data, &states); err != nil {
+		return errors.Wrap(err, "unmarshal sessions")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, st := range states {
+		if _, ok := s.sessions[st.Identifier]; ok || st.Identifier == "" || st.Remaining <= 0 {
+			continue
+		}
+		sess := s.startSession(st.Identifier, st.RemoteHost, st.Remaining)
+		sess.will = st.LastWill
+		if !st.ConnectedAt.IsZero() {
+			sess.connectedAt, sess.startedAt = st.ConnectedAt, st.ConnectedAt
+		}
+	}
+	return nil
+}
+
+// Handover send all sessions to the HandoverHandler of target, then forget them
+func (s *Server) Handover(ctx context.Context, target string) error {
+	s.mu.Lock()
+	s.draining = true
+	states := s.snapshot()
+	s.mu.Unlock()
+
+	err := s.postHandover(ctx, target, states)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.draining = false
+		s.undrain()
+		return err
+	}
+	for _, st := range states {
+		if sess, ok := s.sessions[st.Identifier]; ok {
+			s.removeSession(sess)
+		}
+	}
+	return nil
+}
+
+func (s *Server) postHandover(ctx context.Context, target string, states []SessionState) error {
+	body, err := json.Marshal(states)
+	if err != nil {
+		return errors.Wrap(err, "marshal sessions")
+	}
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "new request")
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Heartbeat-Timestamp", timestamp)
+	secret, _ := s.config()
+	req.Header.Set("X-Heartbeat-Signature", hashHandover(timestamp, body, secret))
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "post handover")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("handover: %s", strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// HandoverHandler accept sessions sent by Handover of a server having the same secret
+func (s *Server) HandoverHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		timestamp := r.Header.Get("X-Heartbeat-Timestamp")
+		signature := r.Header.Get("X-Heartbeat-Signature")
+		secret, timeout := s.config()
+		if !hmac.Equal([]byte(signature), []byte(hashHandover(timestamp, body, secret))) {
+			http.Error(w, "signature wrong", http.StatusForbidden)
+			return
+		}
+		t, _ := strconv.ParseInt(timestamp, 10, 64)
+		if d := time.Now().Unix() - t; d < -1 || d > int64(timeout.Seconds()) {
+			http.Error(w, "Invalid timestamp, advanced or outdated", http.StatusBadRequest)
+			return
+		}
+		if err := s.UnmarshalSessions(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+}
+
+func hashHandover(timestamp string, body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + ":"))
+	mac.Write(body)
+	mac.Write([]byte(":handover"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
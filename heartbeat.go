@@ -6,30 +6,36 @@ Client (HTTP Request) ->
 	Query: identifier (uniq string)
 	Query: timestamp (seconds since January 1, 1970 UTC.)
 	Query: hashmac
+	Query: extra, extraMAC (optional, see request.go)
 
 Server response ->
 	Body: {timestamp} {hashmac}
+	      {extra} {extramac} (optional, see reply.go)
 */
 package heartbeat
 
 import (
 	"context"
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
+	"runtime/pprof"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/codeskyblue/realip"
-	"github.com/codeskyblue/safetime"
 	"github.com/pkg/errors"
 )
 
@@ -37,10 +43,253 @@ type Server struct {
 	OnConnect    func(identifier string, req *http.Request)
 	OnReconnect  func(identifier string, req *http.Request)
 	OnDisconnect func(identifier string)
-	hbTimeout    time.Duration
-	secret       string // HMAC
-	sessions     map[string]*Session
-	mu           sync.Mutex
+
+	// CoalesceDisconnect hold the disconnect callbacks for this window, dropping them and the connect callbacks
+	// when the identifier connect again meanwhile, see coalesce.go. Zero call them at once.
+	CoalesceDisconnect time.Duration
+
+	// OnLastWill is called after OnDisconnect with the Client.LastWill of a session that timed out, see will.go
+	OnLastWill func(identifier, will string)
+
+	// OnInterval is called after OnDisconnect with the span the session was online, see ConnectionInterval.
+	// The same record is in the Interval of EventDisconnect.
+	OnInterval func(ConnectionInterval)
+
+	// KeyWindow derive the HMAC key from the secret per time window, KeyWindowSkew windows each side
+	// are accepted (default 1), KeyWindowLegacy also accept the plain secret. See windowkey.go.
+	KeyWindow       time.Duration
+	KeyWindowSkew   int
+	KeyWindowLegacy bool
+
+	// PublicKeyFunc enable the Ed25519 mode (see ed25519.go): beats carrying a signature are verified
+	// against the public key of identifier instead of the secret, a nil key reject the identifier.
+	// Keyed identifiers also refuse HMAC and AuthFunc beats, return ErrKeyRevoked to revoke one.
+	// RequireSignature refuse HMAC and AuthFunc beats of every identifier.
+	// SigningKey sign the replies to those beats, so their clients need no secret at all.
+	PublicKeyFunc    func(identifier string) (ed25519.PublicKey, error)
+	RequireSignature bool
+	SigningKey       ed25519.PrivateKey
+
+	// AuthFunc is an alternate authenticator tried when the request carries no messageMAC,
+	// e.g. clients presenting a bearer token or a TLS client certificate.
+	// Return ok=false to reject the request, the returned identifier is used for the session.
+	//
+	// Requests accepted by AuthFunc skip the HMAC and timestamp checks entirely,
+	// so the security of those clients depends only on AuthFunc. Their extra (form field "extra",
+	// url encoded, not signed) go through the same checks as any beat: LastConnectionWins,
+	// RequireAdvertisedInterval, StatusVersionPolicy, RequireBuild and MinBuild.
+	// Leave it nil to accept HMAC clients only.
+	AuthFunc func(r *http.Request) (identifier string, ok bool, err error)
+
+	// FreshnessFunc replace the built-in check that the timestamp echoed by the client is within the timeout,
+	// e.g. to accept a counter or a challenge issued by the server (Clock, ReplyFunc) for clients without clock.
+	// An error reject the beat with 400. It fully replace the timestamp check: a FreshnessFunc accepting
+	// old values let a captured beat be replayed, unless ReplayProtection (still applied after it) catch it.
+	// The MAC check is unchanged and run before it.
+	FreshnessFunc func(identifier, timestamp string, r *http.Request) error
+
+	// ReplayProtection reject a messageMAC already seen within the timeout.
+	// The server timestamp then carry a fractional part, unique per reply, so every beat of a client has its own
+	// messageMAC however fast it beat. A FreshnessFunc sees this timestamp.
+	// ReplayCacheSize bound the number of remembered messageMAC, default 65536.
+	ReplayProtection bool
+	ReplayCacheSize  int
+
+	// ConnectGrace is the timeout armed for the first interval after connect,
+	// so a client busy starting up is not declared offline right away.
+	// Later beats use the normal timeout. It only extend the first interval:
+	// a TimeoutForIdentifier longer than the grace win.
+	ConnectGrace time.Duration
+
+	// ProfileLabels set the pprof label "identifier" (and "group" with GroupFunc) around session handling and callbacks,
+	// so CPU profiles show which clients drive the cost.
+	// Labeling allocate a new context and label set on every beat, keep it off unless profiling.
+	ProfileLabels bool
+
+	// ShardFunc return the preferred endpoint of identifier in a sharded deployment,
+	// or empty string if this node is the preferred one.
+	// A non-empty endpoint is sent to the client as a signed redirect directive.
+	// The beat is still recorded on this node, so clients ignoring the directive keep working.
+	ShardFunc func(identifier string) string
+
+	// ReplyFunc return extra key values sent (signed) to the client with the reply of each beat,
+	// e.g. a feature flag, received by Client.OnReply. Output over 1KB encoded is dropped.
+	// It runs on the hot path of every beat, it must be fast.
+	ReplyFunc func(identifier string) (extra map[string]string)
+
+	// ReplyTransform return the body written for the signed reply, e.g. FrameReply, see reply.go for the contract
+	ReplyTransform func(signed []byte) []byte
+
+	// Clock return the current time used for timestamps checked and sent to clients, and for
+	// session deadlines, default time.Now. Tests can fix it to get deterministic replies.
+	// NewTimer create the session timers, default to real ones. See clock.go for faking both.
+	Clock    func() time.Time
+	NewTimer func(d time.Duration) Timer
+
+	// GroupFunc return the group (tenant) of identifier, quotas of GroupQuotas apply per group.
+	// Groups not in GroupQuotas use DefaultGroupQuota. Nil GroupFunc put everyone in group "".
+	GroupFunc         func(identifier string) string
+	GroupQuotas       map[string]GroupQuota
+	DefaultGroupQuota GroupQuota
+
+	// CreditRate enable beat credits per identifier, refilled at CreditRate per second up to CreditBurst
+	// (default 10), see credit.go. Out of credit clients get 429, well behaved ones get priority over GroupQuota.Rate.
+	CreditRate  float64
+	CreditBurst int
+
+	// Clients with AdvertiseInterval send the shortest interval they beat at.
+	// A beat arriving sooner than advertised*(1-IntervalTolerance) after the previous one is a violation,
+	// counted by CadenceViolations, reported to OnCadenceViolation, and rejected with 429 if RejectCadenceViolation.
+	// IntervalTolerance default 0.5. RequireAdvertisedInterval reject beats without an advertised interval.
+	IntervalTolerance         float64
+	RequireAdvertisedInterval bool
+	RejectCadenceViolation    bool
+	OnCadenceViolation        func(identifier string, advertised, actual time.Duration)
+
+	// LastConnectionWins keep a single session per identifier: a beat from another device,
+	// told apart by FingerprintFunc (default the client IP), disconnect the session with ReasonSuperseded
+	// and take it over, see takeover.go for the tie-breaking
+	LastConnectionWins bool
+	FingerprintFunc    func(r *http.Request) string
+
+	// ReconnectPolicy decide whether a beat coming back soon after its session ended is a new connect,
+	// a continuation or ignored, with one window for each way the session ended, see reconnect.go.
+	// Nil use the default policy: only beats within ByeWindow after a goodbye are ignored.
+	ReconnectPolicy *ReconnectPolicy
+
+	// ByeWindow is how long beats are ignored after a client said goodbye (Client.Bye),
+	// so a late beat does not reconnect a session closed on purpose. Default 5s. Unused with a ReconnectPolicy.
+	ByeWindow time.Duration
+
+	// OnGapExceeded is called when the gap between two beats of a session is over GapThreshold,
+	// an early warning before the session time out
+	GapThreshold  time.Duration
+	OnGapExceeded func(identifier string, gap time.Duration)
+
+	// StatusVersionPolicy reject beats whose status document (Client.SetStatus) has a schema
+	// version it return an error for, e.g. unknown or too new versions, at handshake too. Nil accept every version.
+	StatusVersionPolicy func(version int) error
+
+	// EventBuffer is the size of the Events channel, default 256.
+	// EventOverflow decide what to do when it is full, default DropNewest.
+	EventBuffer   int
+	EventOverflow OverflowPolicy
+
+	// RequireBuild refuse beats without Client.Build, MinBuild refuse builds below it, see build.go
+	RequireBuild bool
+	MinBuild     string
+
+	// TimeoutForIdentifier return the timeout of the session of identifier, zero for the server timeout.
+	// It is evaluated when the session is created, by Reconfigure with rearm and by RefreshTimeouts,
+	// holding the server lock like OnConnect, so it must be fast and not call Server methods.
+	TimeoutForIdentifier func(identifier string) time.Duration
+
+	// ProcessSynchronously update the session before replying, see applyBeat for the tradeoff.
+	// Replies then confirm recorded beats with a signed flag, see Client.Recorded.
+	// Default to updating it in the background.
+	ProcessSynchronously bool
+
+	// SignalBuffer is the buffer of the channel carrying beats to the timer goroutine of each session,
+	// default 1, read when a session is created. See SignalStats for the tradeoff.
+	SignalBuffer int
+
+	// MaxWorkers cap the goroutines updating sessions after requests, see dispatch.
+	// Zero start one goroutine per request. WorkQueue is the queue size, default 16*MaxWorkers.
+	MaxWorkers int
+	WorkQueue  int
+
+	// DisconnectOnClose disconnect a session as soon as the connection of its last beat is closed,
+	// see ConnState. The timeout stay as the backstop for half-open connections.
+	DisconnectOnClose bool
+
+	// OnAbsent is called when an identifier of the roster (SetExpected) is not online for over AbsentGrace,
+	// see SetExpected for the evaluation every RosterInterval
+	OnAbsent       func(identifier string, since time.Time)
+	AbsentGrace    time.Duration
+	RosterInterval time.Duration
+
+	// OnClientGap receive the periods a client (with Client.ReportGaps) failed to beat, once it recovered
+	OnClientGap func(identifier string, from, to time.Time)
+
+	// SendEpoch add the epoch of this Server to every reply, see epoch.go
+	SendEpoch bool
+
+	// OnShed is called for each beat answered with 200 but not recorded in its session, see ShedReason.
+	// It tell healthy load shedding apart from failing clients.
+	OnShed func(identifier string, reason ShedReason)
+
+	// ReadyFunc check the dependencies the server need to maintain presence, e.g. ping the store
+	// sessions are persisted to from the callbacks. Its result is cached for ReadyCacheTTL (default 1s)
+	// and reported by ReadyHandler. RejectUnready also answer beats with 503 while it fail,
+	// so clients move to a healthy node. Beats accepted before the failure is seen are still recorded.
+	ReadyFunc     func(ctx context.Context) error
+	ReadyCacheTTL time.Duration
+	RejectUnready bool
+
+	// MemoryBudget cap the approximate bytes of the server state, see MemoryStats and memory.go
+	// for the accounting and what is trimmed when over it. Zero is unlimited.
+	MemoryBudget int64
+
+	// Metrics receive counters, gauges and histograms of beats and sessions, see metrics.go
+	Metrics Metrics
+
+	// AccessLog is called once at the end of every request to the beat endpoint
+	AccessLog func(AccessRecord)
+
+	// RejectionAudit keep the last RejectionAudit rejected requests (status 4xx and 5xx) for RejectedBeats,
+	// 1 out of RejectionAuditSample (default every one). MACs are truncated, bodies not kept.
+	RejectionAudit       int
+	RejectionAuditSample int
+
+	// AnonymizeFunc replace identifiers in logs, access records and pprof labels,
+	// e.g. with a hash, so they do not leak personal data. Sessions, callbacks and events keep
+	// the real identifier. Default to no anonymization.
+	AnonymizeFunc func(identifier string) string
+
+	hbTimeout  time.Duration
+	secret     string // HMAC
+	sessions   map[string]*Session
+	mu         sync.Mutex
+	replay     *ttlCache
+	replayOnce sync.Once
+	draining   bool // set by Handover, beats are refused
+	migration  *migration
+	held       map[string]*heldDisconnect // by CoalesceDisconnect
+	throttles  map[string]*throttle
+	blocked    map[string]bool
+	lifetimes  histogram
+
+	groups        map[string]*groupState
+	events        chan Event
+	watchers      map[string][]func(Event)
+	ended         map[string]ended // last session of identifiers, for ReconnectPolicy
+	commands      map[string][]Command
+	droppedEvents uint64
+
+	cadenceViolations uint64
+	restartIn         time.Duration // set by Drain
+	frozen            bool          // set by FreezeExpiry
+	queue             chan func()
+	poolOnce          sync.Once
+	busyWorkers       int64
+	pendingWork       int64
+	stopping          bool // set by Shutdown, beats are refused
+	stopped           bool // set by Shutdown, sessions are not updated anymore
+	rejectedWork      uint64
+	beatSeq           uint64
+	probes            uint64
+	lastTimestamp     int64 // unix nanoseconds of the last timestamp issued with ReplayProtection
+	conns             map[net.Conn]map[*Session]bool
+	shedCounts        map[ShedReason]uint64
+	credits           map[string]*tokenBucket
+	readyMu           sync.Mutex
+	readiness         readiness
+	budgetChecked     time.Time
+	overBudget        bool
+	audit             auditRing
+	epoch             string
+	epochOnce         sync.Once
+	roster            roster
 }
 
 // NewServer accept secret, Client must have the same secret, so they can work together.
@@ -53,92 +302,516 @@ func NewServer(secret string, timeout time.Duration) *Server {
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.AccessLog == nil && s.Metrics == nil && s.RejectionAudit <= 0 {
+		s.serveBeat(w, r)
+		return
+	}
+	start := time.Now()
+	rec := &accessRecorder{ResponseWriter: w, status: http.StatusOK}
+	identifier := s.serveBeat(rec, r)
+	if s.Metrics != nil {
+		s.Metrics.IncCounter(MetricRequests, "code", strconv.Itoa(rec.status))
+		s.Metrics.ObserveHistogram(MetricRequestSeconds, time.Since(start).Seconds())
+	}
+	if s.RejectionAudit > 0 && rec.status >= 400 {
+		s.auditRejection(r, identifier, rec.status, string(rec.reason))
+	}
+	if s.AccessLog == nil {
+		return
+	}
+	s.AccessLog(AccessRecord{
+		Identifier: s.anonymize(identifier),
+		Status:     rec.status,
+		Reason:     strings.TrimSpace(string(rec.reason)),
+		Latency:    time.Since(start),
+		RemoteAddr: realip.FromRequest(r),
+	})
+}
+
+// serveBeat handle one beat, return the identifier if known
+func (s *Server) serveBeat(w http.ResponseWriter, r *http.Request) (identifier string) {
+	secret, timeout := s.config()
 	timestamp := r.FormValue("timestamp")
-	identifier := r.FormValue("identifier")
+	identifier = r.FormValue("identifier")
 	messageMAC := r.FormValue("messageMAC")
 
+	if s.isDraining() {
+		http.Error(w, "server draining", http.StatusServiceUnavailable)
+		return
+	}
+	if s.RejectUnready {
+		if err := s.ready(); err != nil {
+			http.Error(w, "not ready: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	signed := messageMAC == "" && r.FormValue(fieldSignature) != "" && s.PublicKeyFunc != nil
+	if messageMAC == "" && !signed && s.AuthFunc != nil {
+		return s.serveCustomAuth(w, r)
+	}
+	if identifier == "" {
+		http.Error(w, "identifier should not be empty", http.StatusBadRequest)
+		return
+	}
+	var extra url.Values
+	if signed {
+		var ok bool
+		if extra, ok = s.verifySignature(w, r, timestamp, identifier); !ok {
+			return
+		}
+		messageMAC = r.FormValue(fieldSignature) // deterministic, good for replay detection too
+	} else {
+		// check hash MAC, secret become the key it was made with
+		var ok bool
+		if secret, ok = s.matchKey(timestamp, identifier, secret, messageMAC); !ok {
+			http.Error(w, "messageMAC wrong", http.StatusBadRequest)
+			return
+		}
+		if !s.checkUnsigned(w, identifier) {
+			return
+		}
+		var err error
+		if extra, err = readRequestExtra(r, timestamp, identifier, secret); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	sg := s.serverSigner(secret, signed)
+	if extra.Get(fieldProbe) != "" {
+		if !s.admitProbe(w, identifier) {
+			return
+		}
+		s.serveProbe(w, r, identifier, timestamp, messageMAC, sg, timeout)
+		return
+	}
+	if !s.admit(w, identifier) || !s.checkSuperseded(w, r, identifier) {
+		return
+	}
+	var recorded bool
+	if timestamp == "" {
+		if !s.checkHandshake(w, extra) {
+			return
+		}
+	} else {
+		if !s.checkTimestamp(w, r, identifier, timestamp, messageMAC, timeout) {
+			return
+		}
+		var ok bool
+		if recorded, ok = s.applyChecked(w, r, identifier, extra); !ok {
+			return
+		}
+	}
+
+	s.writeReply(w, identifier, sg, recorded)
+	return
+}
+
+// checkHandshake refuse at handshake the clients their beats would be refused for, whatever the session.
+// Their first beat would fail after a successful handshake, and the client reconnect at once.
+func (s *Server) checkHandshake(w http.ResponseWriter, extra url.Values) bool {
+	if _, ok := s.advertisedInterval(w, extra); !ok {
+		return false
+	}
+	return s.checkBuild(w, extra) && s.checkStatus(w, extra) && s.checkWill(w, extra)
+}
+
+// applyChecked check the extra of an authenticated beat and apply it, a bye included.
+// Return false when the beat was refused, the error is already written.
+func (s *Server) applyChecked(w http.ResponseWriter, r *http.Request, identifier string, extra url.Values) (recorded, ok bool) {
+	if extra.Get(fieldBye) != "" {
+		s.ackCommands(identifier, extra[fieldAck])
+		s.bye(identifier)
+		return true, true
+	}
+	if !s.checkCadence(w, identifier, extra) || !s.checkStatus(w, extra) || !s.checkBuild(w, extra) ||
+		!s.checkWill(w, extra) {
+		return false, false
+	}
+	s.noteRestartAck(identifier, extra)
+	s.ackCommands(identifier, extra[fieldAck])
+	if recorded, ok = s.applyBeat(identifier, r, extra); !ok {
+		writeRetryAfter(w, "server busy", http.StatusServiceUnavailable, retryAfterBusy)
+	}
+	return
+}
+
+func (s *Server) serveCustomAuth(w http.ResponseWriter, r *http.Request) (identifier string) {
+	identifier, ok, err := s.AuthFunc(r)
+	if err != nil {
+		http.Error(w, "auth: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
 	if identifier == "" {
 		http.Error(w, "identifier should not be empty", http.StatusBadRequest)
 		return
 	}
-	// check hash MAC
-	if messageMAC != hashIdentifier(timestamp, identifier, s.secret) {
-		http.Error(w, "messageMAC wrong", http.StatusBadRequest)
+	// AuthFunc vouch for the whole request, the extra is taken as sent
+	extra, err := url.ParseQuery(r.FormValue("extra"))
+	if err != nil {
+		http.Error(w, "extra: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	// check timestamp
-	if timestamp != "" {
+	if !s.checkUnsigned(w, identifier) || !s.admit(w, identifier) || !s.checkSuperseded(w, r, identifier) {
+		return
+	}
+	recorded, ok := s.applyChecked(w, r, identifier, extra)
+	if !ok {
+		return
+	}
+	secret, _ := s.config()
+	s.writeReply(w, identifier, hmacSigner(secret), recorded)
+	return
+}
+
+// checkTimestamp reject outdated and replayed beats
+func (s *Server) checkTimestamp(w http.ResponseWriter, r *http.Request, identifier, timestamp, messageMAC string, timeout time.Duration) bool {
+	now := s.now()
+	if s.FreshnessFunc != nil {
+		if err := s.FreshnessFunc(identifier, timestamp, r); err != nil {
+			http.Error(w, "Invalid timestamp, "+err.Error(), http.StatusBadRequest)
+			return false
+		}
+	} else {
 		var t int64
 		fmt.Sscanf(timestamp, "%d", &t)
-		if time.Now().Unix()-t < 0 || time.Now().Unix()-t > int64(s.hbTimeout.Seconds()) {
+		if now.Unix()-t < 0 || now.Unix()-t > int64(timeout.Seconds()) {
 			http.Error(w, "Invalid timestamp, advanced or outdated", http.StatusBadRequest)
-			return
+			return false
+		}
+	}
+	if s.ReplayProtection {
+		if !s.replayCache().add(messageMAC, now, now.Add(timeout)) {
+			http.Error(w, "messageMAC replayed", http.StatusBadRequest)
+			return false
 		}
-		go s.updateOrSaveSession(identifier, r)
 	}
+	return true
+}
 
-	// send server timestamp to client
-	t := time.Now().Unix()
-	fmt.Fprintf(w, "%d %s", t, hashTimestamp(fmt.Sprintf("%d", t), s.secret))
+// send server timestamp and directives to client, recorded tell the beat was applied before the reply
+func (s *Server) writeReply(w http.ResponseWriter, identifier string, sg replySigner, recorded bool) {
+	extra := url.Values{}
+	if recorded {
+		extra.Set(extraRecorded, "1")
+	}
+	if s.ShardFunc != nil {
+		if endpoint := s.ShardFunc(identifier); endpoint != "" {
+			extra.Set(extraRedirect, endpoint)
+		}
+	}
+	s.restartExtra(extra)
+	s.epochExtra(extra)
+	s.commandExtra(identifier, extra)
+	if s.ReplyFunc != nil {
+		if !addUserExtra(extra, s.ReplyFunc(identifier)) {
+			log.Printf("heartbeat: reply extra of %s over %d bytes, dropped", s.anonymize(identifier), maxUserExtra)
+		}
+	}
+	s.sendReply(w, s.timestamp(), sg, extra)
+}
+
+func (s *Server) now() time.Time {
+	if s.Clock != nil {
+		return s.Clock()
+	}
+	return time.Now()
 }
 
-func (s *Server) updateOrSaveSession(identifier string, req *http.Request) {
+// updateOrSaveSession apply a beat, seq is its arrival order from applyBeat.
+// Return false when the beat was shed.
+func (s *Server) updateOrSaveSession(identifier string, req *http.Request, extra url.Values, seq uint64) (recorded bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	switch {
+	case s.draining || s.stopped:
+		s.shed(identifier, ShedDraining)
+		return false
+	case s.blocked[identifier]:
+		s.shed(identifier, ShedBlocked)
+		return false
+	}
+	sess, online := s.sessions[identifier]
+	if online && seq < sess.seq {
+		s.shed(identifier, ShedOutOfOrder)
+		return false
+	}
+	var fingerprint string
+	var superseded []string
+	if s.LastConnectionWins {
+		fingerprint = s.fingerprint(req)
+		if online && s.superseded(identifier, fingerprint) {
+			s.shed(identifier, ShedSuperseded)
+			return false
+		}
+		if online && sess.fingerprint != fingerprint {
+			superseded = s.takeover(sess)
+			online = false
+		}
+	}
+	action, prev := ReconnectNew, ended{}
+	if !online && superseded == nil {
+		if action, prev = s.reconnectAction(identifier); action == ReconnectIgnore {
+			if prev.reason == ReasonBye {
+				s.shed(identifier, ShedByeWindow)
+			} else {
+				s.shed(identifier, ShedReconnectWindow)
+			}
+			return false
+		}
+	}
+	s.reportGaps(identifier, extra)
+	group := s.groupOf(identifier)
 	remoteHost := realip.FromRequest(req)
-	if sess, ok := s.sessions[identifier]; ok {
+	if online {
 		// Call OnReconnect again when client IP changes
 		if sess.remoteHost != remoteHost {
 			sess.remoteHost = remoteHost
 			if s.OnReconnect != nil {
-				s.OnReconnect(identifier, req)
+				s.callback("OnReconnect", func() { s.OnReconnect(identifier, req) })
 			}
+			s.metrics().IncCounter(MetricReconnects)
+			s.emit(EventReconnect, sess)
 		}
-		select {
-		case sess.recvC <- "beat":
-			// log.Println(sess.identifier, "beat")
-		default:
-		}
+		s.metrics().IncCounter(MetricBeats)
+		sess.seq = seq
+		s.storeStatus(sess, extra)
+		s.storeBuild(sess, extra)
+		s.storeWill(sess, extra)
+		s.observeBeat(sess)
+		s.emit(EventBeat, sess)
+		s.bindConn(sess, req)
+		s.rearm(sess, sess.timeout)
 	} else {
-		if s.OnConnect != nil {
-			s.OnConnect(identifier, req)
-		}
-		sess := &Session{
-			identifier: identifier,
-			remoteHost: remoteHost,
-			timer:      safetime.NewTimer(s.hbTimeout),
-			timeout:    s.hbTimeout,
-			recvC:      make(chan string, 0),
-		}
-		s.sessions[identifier] = sess
-		go func() {
-			sess.drain()
+		if q := s.groupQuota(group); q.MaxSessions > 0 && s.group(group).sessions >= q.MaxSessions {
+			s.shed(identifier, ShedGroupQuota)
+			return false
+		}
+		if !s.checkBudget() {
+			s.shed(identifier, ShedMemoryBudget)
+			return false
+		}
+		delete(s.ended, identifier)
+		resume := action == ReconnectResume
+		held := s.coalesce(identifier)
+		if resume {
+			if s.OnReconnect != nil && held == nil {
+				s.callback("OnReconnect", func() { s.OnReconnect(identifier, req) })
+			}
+			s.metrics().IncCounter(MetricReconnects)
+		} else {
+			if s.OnConnect != nil && held == nil {
+				s.callback("OnConnect", func() { s.OnConnect(identifier, req) })
+			}
+			s.metrics().IncCounter(MetricConnects)
+		}
+		s.metrics().IncCounter(MetricBeats)
+		firstTimeout := s.timeoutFor(identifier)
+		if s.ConnectGrace > firstTimeout {
+			firstTimeout = s.ConnectGrace
+		}
+		sess := s.startSession(identifier, remoteHost, firstTimeout)
+		if resume && !prev.connectedAt.IsZero() {
+			sess.connectedAt = prev.connectedAt
+		}
+		if held != nil { // one continuous session for the callbacks
+			sess.connectedAt, sess.startedAt = held.sess.connectedAt, held.sess.startedAt
+		}
+		sess.fingerprint, sess.superseded = fingerprint, superseded
+		sess.seq = seq
+		s.storeStatus(sess, extra)
+		s.storeBuild(sess, extra)
+		s.storeWill(sess, extra)
+		s.observeBeat(sess)
+		s.bindConn(sess, req)
+		if resume {
+			s.emit(EventReconnect, sess)
+		} else {
+			s.emit(EventConnect, sess)
+		}
+	}
+	return true
+}
+
+// startSession add a session expiring after firstTimeout, must hold s.mu
+func (s *Server) startSession(identifier, remoteHost string, firstTimeout time.Duration) *Session {
+	now := s.now() // before arming the timer, so it never fire before deadline
+	sess := &Session{
+		identifier:  identifier,
+		remoteHost:  remoteHost,
+		timer:       s.newTimer(firstTimeout),
+		timeout:     s.timeoutFor(identifier),
+		connectedAt: now,
+		startedAt:   now,
+		deadline:    now.Add(firstTimeout),
+		armedAt:     now,
+		armedFor:    firstTimeout,
+		recvC:       make(chan time.Duration, s.signalBuffer()),
+		quitC:       make(chan struct{}),
+	}
+	s.sessions[identifier] = sess
+	if s.frozen {
+		sess.remaining = firstTimeout
+		sess.signal(now, 0)
+	}
+	sess.group = s.groupOf(identifier)
+	s.group(sess.group).sessions++
+	s.metrics().SetGauge(MetricSessions, float64(len(s.sessions)))
+	go func() {
+		for sess.drain() {
 			// delete session when timeout
-			s.mu.Lock()
-			defer s.mu.Unlock()
-			if s.OnDisconnect != nil {
-				s.OnDisconnect(identifier)
+			expired := true
+			s.withLabels(identifier, func() {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				if s.sessions[identifier] != sess {
+					return
+				}
+				if s.frozen {
+					// fired right before FreezeExpiry, wait for UnfreezeExpiry
+					sess.remaining = 0
+					expired = false
+					return
+				}
+				s.disconnect(sess, ReasonTimeout)
+			})
+			if expired {
+				return
 			}
-			delete(s.sessions, identifier)
-		}()
+		}
+		// removed by removeSession
+	}()
+	return sess
+}
+
+// disconnect remove the session, record its lifetime and call OnDisconnect, must hold s.mu
+func (s *Server) disconnect(sess *Session, reason DisconnectReason) {
+	s.removeSession(sess)
+	sess.reason = reason
+	s.noteEnded(sess.identifier, reason, sess.connectedAt)
+	lifetime := s.now().Sub(sess.connectedAt)
+	s.lifetimes.observe(lifetime)
+	s.metrics().IncCounter(MetricDisconnects)
+	s.metrics().ObserveHistogram(MetricSessionLifetime, lifetime.Seconds())
+	iv := s.interval(sess)
+	s.notifyDisconnect(sess, func() {
+		if s.OnDisconnect != nil {
+			s.callback("OnDisconnect", func() { s.OnDisconnect(sess.identifier) })
+		}
+		if will := lastWill(sess); will != "" && s.OnLastWill != nil {
+			s.callback("OnLastWill", func() { s.OnLastWill(sess.identifier, will) })
+		}
+		if s.OnInterval != nil {
+			s.callback("OnInterval", func() { s.OnInterval(iv) })
+		}
+	})
+	s.emit(EventDisconnect, sess)
+}
+
+// removeSession delete the session and stop its timer without calling OnDisconnect, must hold s.mu
+func (s *Server) removeSession(sess *Session) {
+	if s.sessions[sess.identifier] == sess {
+		delete(s.sessions, sess.identifier)
+		s.group(sess.group).sessions--
+		s.metrics().SetGauge(MetricSessions, float64(len(s.sessions)))
+		s.unbindConn(sess)
+		close(sess.quitC)
+	}
+}
+
+// withLabels run fn with pprof labels when ProfileLabels is set
+func (s *Server) withLabels(identifier string, fn func()) {
+	if !s.ProfileLabels {
+		fn()
+		return
+	}
+	labels := pprof.Labels("identifier", s.anonymize(identifier))
+	if s.GroupFunc != nil {
+		labels = pprof.Labels("identifier", s.anonymize(identifier), "group", s.GroupFunc(identifier))
 	}
+	pprof.Do(context.Background(), labels, func(context.Context) {
+		fn()
+	})
 }
 
 type Session struct {
-	identifier string
-	remoteHost string
-	timer      *safetime.Timer
-	timeout    time.Duration
-	recvC      chan string
+	identifier    string
+	remoteHost    string
+	timer         Timer
+	timeout       time.Duration
+	deadline      time.Time // when the session will time out, guarded by Server.mu
+	connectedAt   time.Time
+	startedAt     time.Time // of this session, connectedAt is carried over by ReconnectResume
+	group         string
+	lastArrival   time.Time // last beat with an advertised interval
+	restartAcked  bool
+	remaining     time.Duration // timeout left when expiry is frozen
+	arrivals      interarrival
+	conn          net.Conn         // connection of the last beat, with DisconnectOnClose
+	reason        DisconnectReason // why it was disconnected
+	fingerprint   string           // with LastConnectionWins
+	superseded    []string         // fingerprints refused, displaced by this session
+	armedAt       time.Time        // last signal arming the timer, for DiagnoseSessions
+	armedFor      time.Duration    // timeout of that signal
+	stopped       bool             // last signal stopped the timer
+	resets        uint64           // signals sent to drain
+	coalesced     uint64           // signals replaced before drain took them
+	highWater     int              // most signals waiting in recvC
+	seq           uint64           // arrival order of the last beat applied
+	status        string
+	statusVersion int
+	build         string             // Client.Build of the last beat
+	will          string             // Client.LastWill of the last beat
+	recvC         chan time.Duration // timeout to reset the timer to
+	quitC         chan struct{}
 }
 
-func (sess *Session) drain() {
+// signal ask drain to reset the timer to d at now, replacing a pending signal, must hold Server.mu
+// d <= 0 stop the timer.
+func (sess *Session) signal(now time.Time, d time.Duration) {
+	if d > 0 {
+		sess.deadline = now.Add(d)
+		sess.armedAt, sess.armedFor = now, d
+	}
+	sess.stopped = d <= 0
+	sess.resets++
+	// never block, senders are serialized by Server.mu: when the buffer is full the oldest signal
+	// is replaced, only the last timeout matter to the timer
 	for {
 		select {
-		case <-sess.recvC:
-			sess.timer.Reset(sess.timeout)
-		case <-sess.timer.C:
+		case sess.recvC <- d:
+			if n := len(sess.recvC); n > sess.highWater {
+				sess.highWater = n
+			}
 			return
+		default:
+		}
+		select {
+		case <-sess.recvC:
+			sess.coalesced++
+		default:
+		}
+	}
+}
+
+// drain reset the timer on every beat, return true on timeout and false when quitC closed
+func (sess *Session) drain() bool {
+	for {
+		select {
+		case d := <-sess.recvC:
+			if d <= 0 {
+				sess.timer.Stop()
+			} else {
+				sess.timer.Reset(d)
+			}
+		case <-sess.timer.C():
+			return true
+		case <-sess.quitC:
+			sess.timer.Stop()
+			return false
 		}
 	}
 }
@@ -149,68 +822,332 @@ type Client struct {
 	ServerAddr string
 	OnConnect  func()
 	OnError    func(error)
+	OnReply    func(extra map[string]string) // key values from Server.ReplyFunc
+
+	// ReplyExtract return the signed reply out of the body received, e.g. UnframeReply, see reply.go
+	ReplyExtract func(body []byte) ([]byte, error)
+
+	// ReportGaps remember the periods beats failed and report them to the server on recovery, see gap.go
+	ReportGaps bool
+
+	// OnStaleTimestamp is called once when StaleThreshold (default 3) beats in a row were rejected
+	// as stale, with the count, see IsStaleTimestamp. Each is already retried with a new timestamp.
+	OnStaleTimestamp func(count int)
+	StaleThreshold   int
+
+	// OnEpochChange is called when the epoch of the server (Server.SendEpoch) change between two replies:
+	// the client switched instance or the instance restarted
+	OnEpochChange func(old, new string)
+
+	// BeatInterval is the base interval used by DoBeat. Beat overwrites it.
+	BeatInterval time.Duration
+
+	// Adaptive let the beat interval self-tune from the measured RTT and loss.
+	// The interval never goes below MinInterval (default: the interval passed to Beat)
+	// and never above a third of ServerTimeout (default: twice the Beat interval).
+	Adaptive      bool
+	MinInterval   time.Duration
+	ServerTimeout time.Duration
+
+	// DegradedInterval is the reduced beat rate used after a failed beat while the session
+	// may still be alive on server, instead of dropping the session and reconnecting.
+	// It last until a beat succeed or ServerTimeout (default: 3 beat intervals) passed since the last success.
+	// Zero disable the degraded mode.
+	DegradedInterval time.Duration
+
+	// AdvertiseInterval send (signed) the shortest interval the client beat at,
+	// so the server can enforce it
+	AdvertiseInterval bool
+
+	// SigningKey sign beats with Ed25519 instead of the HMAC of Secret, see ed25519.go.
+	// ServerKey check the replies of a server having Server.SigningKey, otherwise replies use Secret.
+	SigningKey ed25519.PrivateKey
+	ServerKey  ed25519.PublicKey
+
+	// Probe mark the client as a synthetic monitor, see probe.go.
+	// Its beats are verified by the server but create no session.
+	Probe bool
+
+	// KeyWindow sign with a key derived from Secret per time window, as Server.KeyWindow, see windowkey.go
+	KeyWindow time.Duration
+
+	// LastWill is sent (signed) with every beat, the server deliver it if the session time out, see will.go
+	LastWill string
+
+	// Build is sent (signed) with every beat, "{version}+{commit}", see build.go for the server side
+	Build string
+
+	// Transport is used to send beats, default http.DefaultTransport
+	Transport http.RoundTripper
+
+	// RequestOptions tune the beat requests for finicky proxies, see RequestOptions
+	RequestOptions RequestOptions
+
+	// TLSSessionCache enable TLS session resumption, e.g. tls.NewLRUClientSessionCache(0), so a beat
+	// on a new connection skip the full handshake. Off by default. Transport must be nil or *http.Transport,
+	// for HTTP/3 set it on the TLS config of http3transport (which also offer 0-RTT).
+	TLSSessionCache tls.ClientSessionCache
+
+	// TLSALookup enable DANE, the server certificate is verified against the TLSA records it return
+	// instead of the system trust store. It is opt-in and only as safe as the DNSSEC validation of the lookup.
+	// Transport must be nil or *http.Transport.
+	TLSALookup TLSALookupFunc
+
+	mu       sync.Mutex
+	rtt      time.Duration // smoothed round trip time
+	loss     float64       // smoothed failure ratio, 0 ~ 1
+	interval time.Duration // effective interval
+	timeKey  string        // last server timestamp, empty when not connected
+	next     time.Duration // wait before next DoBeat
+	redirect string        // endpoint from server redirect directive
+	degraded bool          // beating at DegradedInterval
+	lastOK   time.Time     // last successful beat
+	hc       *http.Client
+
+	restartUntil time.Time // server announced a restart, expected to finish before it
+	bye          bool      // next request is a goodbye
+	inbox        []Command
+	acked        map[string]bool // acknowledged, until the server stop sending them
+	migrateTo    string          // target of a migrate command, see migrate.go
+	migrateID    string
+	migrated     bool // switched to migrateTo, the handshake there is not a new connect
+
+	status        string
+	statusVersion int
+	epoch         string    // last server epoch
+	gapStart      time.Time // first failed beat of the current outage
+	gaps          []gap     // outages not yet received by server
+	gapsSent      int       // gaps in the request being sent
+	stale         int       // consecutive stale timestamp rejections
+	recorded      bool      // last beat confirmed recorded by the server
+
+	established bool          // a timestamped beat succeeded, session exist on server
+	permErr     error         // failure retrying can not fix
+	rejections  int           // permanent rejections in a row, see backoff.go
+	changed     chan struct{} // closed and replaced when established or permErr change
 }
 
+const defaultBeatInterval = 5 * time.Second
+
 // Beat send identifier and hmac hash to server every interval
 func (c *Client) Beat(interval time.Duration) (cancel context.CancelFunc) {
-	if !regexp.MustCompile(`^https?://`).MatchString(c.ServerAddr) {
-		c.ServerAddr = "http://" + c.ServerAddr
-	}
+	c.BeatInterval = interval
 	ctx, cancel := context.WithCancel(context.TODO())
 	go func() {
 		for {
-			timeKey, err := c.httpBeat("", c.ServerAddr)
-			if err != nil {
-				sleepDuration := interval + time.Duration(rand.Intn(5))*time.Second
-				// secret might wrong
-				if strings.Contains(err.Error(), "messageMAC wrong") {
-					sleepDuration += 1 * time.Minute
-				}
-				if c.OnError != nil {
-					c.OnError(err)
-				}
-				log.Printf("heatbeat err: %v, retry after %v", err, sleepDuration)
-				time.Sleep(sleepDuration)
-				continue
-			}
-			if c.OnConnect != nil {
-				c.OnConnect()
+			if err := c.DoBeat(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("heatbeat err: %v, retry after %v", err, c.NextBeatAfter())
 			}
-			err = c.beatLoop(ctx, interval, timeKey)
-			if err == nil {
-				break
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(c.NextBeatAfter()):
 			}
 		}
 	}()
 	return cancel
 }
 
-// send hearbeat continously
-func (c *Client) beatLoop(ctx context.Context, interval time.Duration, timeKey string) error {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-	for {
-		newTimeKey, er := c.httpBeat(timeKey, c.ServerAddr)
-		if er != nil {
-			return errors.Wrap(er, "beatLoop")
+// DoBeat send one beat to server, for hosts which drive the beat from their own timer.
+// Call NextBeatAfter to know when to call DoBeat again.
+// The first DoBeat (and the first after a failure) only fetch the server timestamp,
+// the next one is due immediately. DoBeat must not be called concurrently.
+func (c *Client) DoBeat(ctx context.Context) error {
+	base := c.BeatInterval
+	if base <= 0 {
+		base = defaultBeatInterval
+	}
+	c.migrate(ctx)
+	c.mu.Lock()
+	serverTimeKey := c.timeKey
+	redirected := c.redirect != ""
+	c.mu.Unlock()
+
+	timeKey, extra, err := c.httpBeat(ctx, serverTimeKey, c.Endpoint())
+	if err != nil {
+		var next time.Duration // reconnect immediately when the beat loop breaks
+		if serverTimeKey == "" {
+			next = base + time.Duration(rand.Intn(5))*time.Second
+			// secret might wrong
+			if strings.Contains(err.Error(), "messageMAC wrong") {
+				next += 1 * time.Minute
+			}
+		} else {
+			err = errors.Wrap(err, "beatLoop")
 		}
-		timeKey = newTimeKey
-		select {
-		case <-ctx.Done():
-			return nil
-		case <-ticker.C:
+		c.mu.Lock()
+		c.noteFailure(time.Now())
+		c.recorded = false
+		staleCount, staleReport := c.noteStale(err)
+		if c.restarting() && serverTimeKey != "" && keepTimeKeyOnRestart(err) {
+			c.next = restartRetryInterval
+		} else if d, ok := c.degradedInterval(base, err); ok && serverTimeKey != "" && !redirected {
+			c.degraded = true
+			c.next = d
+		} else {
+			c.degraded = false
+			c.timeKey = ""
+			c.next = next
+			c.redirect = "" // fallback to ServerAddr
+			c.setState(false, permanentError(err))
+			if c.restarting() {
+				c.next = restartRetryInterval
+			}
+		}
+		if d, ok := retryLaterWait(base, err, c.restarting()); ok && d > c.next {
+			c.next = d
+		}
+		if permanentError(err) != nil {
+			c.rejections++
+			if d := rejectBackoff(base, c.rejections); d > c.next {
+				c.next = d
+			}
+		}
+		c.mu.Unlock()
+		if staleReport && c.OnStaleTimestamp != nil {
+			c.OnStaleTimestamp(staleCount)
+		}
+		if c.OnError != nil {
+			c.OnError(err)
+		}
+		return err
+	}
+	var next time.Duration
+	if serverTimeKey != "" {
+		next = c.nextInterval(base)
+	}
+	c.mu.Lock()
+	c.timeKey = timeKey
+	c.next = next
+	c.degraded = false
+	c.lastOK = time.Now()
+	c.noteSuccess(c.lastOK, serverTimeKey != "")
+	if serverTimeKey != "" {
+		c.noteStale(nil)
+		c.recorded = extra.Get(extraRecorded) != ""
+		c.rejections = 0
+	}
+	c.setState(c.established || serverTimeKey != "", nil)
+	// Only follow redirect from ServerAddr, so two nodes can not bounce the client between them
+	if target := extra.Get(extraRedirect); target != "" && !redirected && target != c.serverAddr() {
+		c.redirect = target
+	}
+	resumed := c.restarting() || c.migrated // same session across the server restart or migration
+	if serverTimeKey == "" {
+		c.migrated = false
+	}
+	c.noteRestart(extra)
+	oldEpoch, epochChanged := c.noteEpoch(extra)
+	c.receiveCommands(extra[extraCommand])
+	c.mu.Unlock()
+	if epochChanged && c.OnEpochChange != nil {
+		c.OnEpochChange(oldEpoch, extra.Get(extraEpoch))
+	}
+	if serverTimeKey == "" && !resumed && c.OnConnect != nil {
+		c.OnConnect()
+	}
+	if user := userExtra(extra); user != nil && c.OnReply != nil {
+		c.OnReply(user)
+	}
+	return nil
+}
+
+// Recorded report whether the server confirmed, in the signed reply, that the last beat was applied
+// to the session before replying (Server.ProcessSynchronously). False for servers updating sessions
+// in the background, where a 200 only mean the beat was accepted, and after a failed beat.
+func (c *Client) Recorded() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.recorded
+}
+
+// NextBeatAfter return how long to wait before the next DoBeat
+func (c *Client) NextBeatAfter() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.next
+}
+
+// Endpoint return the address beats are sent to,
+// ServerAddr or the endpoint it redirected to.
+func (c *Client) Endpoint() string {
+	c.mu.Lock()
+	redirect := c.redirect
+	c.mu.Unlock()
+	if redirect != "" {
+		return redirect
+	}
+	return c.serverAddr()
+}
+
+func (c *Client) serverAddr() string {
+	if !regexp.MustCompile(`^https?://`).MatchString(c.ServerAddr) {
+		return "http://" + c.ServerAddr
+	}
+	return c.ServerAddr
+}
+
+func (c *Client) httpClient() (*http.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hc != nil {
+		return c.hc, nil
+	}
+	transport := c.Transport
+	if c.TLSSessionCache != nil {
+		t, err := sessionCacheTransport(transport, c.TLSSessionCache)
+		if err != nil {
+			return nil, err
 		}
+		transport = t
 	}
+	if c.TLSALookup != nil {
+		t, err := daneTransport(transport, c.TLSALookup)
+		if err != nil {
+			return nil, err
+		}
+		transport = t
+	}
+	c.hc = &http.Client{
+		Transport: transport,
+		Timeout:   5 * time.Second,
+	}
+	return c.hc, nil
 }
 
-func (c *Client) httpBeat(serverTimeKey string, serverAddr string) (timeKey string, err error) {
-	httpclient := http.Client{
-		Timeout: 5 * time.Second,
+func (c *Client) httpBeat(ctx context.Context, serverTimeKey string, serverAddr string) (timeKey string, extra url.Values, err error) {
+	start := time.Now()
+	defer func() {
+		c.observe(time.Since(start), err)
+	}()
+	httpclient, err := c.httpClient()
+	if err != nil {
+		return
 	}
-	resp, err := httpclient.PostForm(serverAddr, url.Values{ // TODO: http timeout
+	form := url.Values{
 		"timestamp":  {serverTimeKey},
-		"identifier": {c.Identifier},
-		"messageMAC": {hashIdentifier(serverTimeKey, c.Identifier, c.Secret)}})
+		"identifier": {c.Identifier}}
+	key := c.hmacKey(time.Now())
+	var encoded string
+	if extra := c.requestExtra(serverTimeKey != ""); len(extra) > 0 {
+		encoded = extra.Encode()
+		form.Set("extra", encoded)
+	}
+	if c.SigningKey != nil {
+		c.signBeat(form, serverTimeKey, encoded)
+	} else {
+		form.Set("messageMAC", hashIdentifier(serverTimeKey, c.Identifier, key))
+		if encoded != "" {
+			form.Set("extraMAC", hashRequestExtra(serverTimeKey, c.Identifier, encoded, key))
+		}
+	}
+	req, err := newBeatRequest(serverAddr, form)
+	if err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	c.RequestOptions.apply(req)
+	resp, err := httpclient.Do(req)
 	if err != nil {
 		err = errors.Wrap(err, "post form")
 		return
@@ -222,22 +1159,18 @@ func (c *Client) httpBeat(serverTimeKey string, serverAddr string) (timeKey stri
 		return
 	}
 	if resp.StatusCode != 200 {
-		err = errors.New(strings.TrimSpace(string(body)))
+		err = replyError(resp, strings.TrimSpace(string(body)))
 		return
 	}
 
 	// Receive server timestamp and check server hmac HASH
-	var hashMAC string
-	n, err := fmt.Sscanf(string(body), "%s %s", &timeKey, &hashMAC)
-	if err != nil {
-		log.Println(n, err)
-		return
-	}
-	if hashTimestamp(timeKey, c.Secret) != hashMAC {
-		err = errors.New("wrong timestamp hmac")
-		return
+	if c.ReplyExtract != nil {
+		if body, err = c.ReplyExtract(body); err != nil {
+			err = errors.Wrap(err, "extract reply")
+			return
+		}
 	}
-	return
+	return parseReply(string(body), c.replySigner(key))
 }
 
 func hashTimestamp(t, secret string) string {
@@ -246,6 +1179,12 @@ func hashTimestamp(t, secret string) string {
 	return hex.EncodeToString(mac.Sum(nil))
 }
 
+func hashExtra(timestamp, extra, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%s:%s:extra", timestamp, extra)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 func hashIdentifier(timestamp, identifier, secret string) string {
 	mac := hmac.New(sha256.New, []byte(secret))
 	mac.Write([]byte(fmt.Sprintf("%s:%s", timestamp, identifier)))
@@ -1,11 +1,28 @@
 package heartbeat
 
 import (
+	"bytes"
+	"container/heap"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 func TestHeartbeat(t *testing.T) {
@@ -32,3 +49,2275 @@ func TestHeartbeat(t *testing.T) {
 	time.Sleep(5e9)
 	log.Println("FINISHED")
 }
+
+func TestAdaptiveInterval(t *testing.T) {
+	c := &Client{Adaptive: true, ServerTimeout: 9 * time.Second}
+	c.observe(10*time.Millisecond, nil)
+	if d := c.nextInterval(time.Second); d != time.Second {
+		t.Fatalf("healthy link should keep base interval, got %v", d)
+	}
+	for i := 0; i < 10; i++ {
+		c.observe(0, errors.New("lost"))
+		c.nextInterval(time.Second)
+	}
+	if d := c.Interval(); d != 3*time.Second {
+		t.Fatalf("interval should be bounded by a third of server timeout, got %v", d)
+	}
+}
+
+func TestReplayProtectionFastBeat(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.ReplayProtection = true
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	var errs int32
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL,
+		OnError: func(err error) {
+			atomic.AddInt32(&errs, 1)
+			t.Log(err)
+		}}
+	cancel := client.Beat(50 * time.Millisecond) // many beats within each second
+	time.Sleep(1500 * time.Millisecond)
+	cancel()
+	time.Sleep(100 * time.Millisecond) // let the last beat finish
+	if n := atomic.LoadInt32(&errs); n != 0 || !client.Connected() {
+		t.Fatalf("beats of a real client should not be taken for replays, %d errors", n)
+	}
+	if st := hbs.ReplayCacheStats(); st.Misses < 10 || st.Hits != 0 {
+		t.Fatalf("expect every beat a new messageMAC, got %+v", st)
+	}
+
+	client.mu.Lock()
+	timeKey := client.timeKey
+	client.mu.Unlock()
+	var body []byte
+	for i := 0; i < 2; i++ { // the beat, then its replay
+		req, _ := BuildBeatRequest(ts.URL, "whoami", "kitty", timeKey, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if !strings.Contains(string(body), "messageMAC replayed") {
+		t.Fatalf("expect a captured beat still refused, got %q", body)
+	}
+}
+
+func TestDegradedReplayProtection(t *testing.T) {
+	hbs := NewServer("kitty", 9*time.Second)
+	hbs.ReplayProtection = true
+	start := time.Now()
+	hbs.Clock = func() time.Time { return start }
+	var beats, drop int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		beats++
+		if beats == drop {
+			// the beat is accepted, its reply lost on the way back
+			hbs.ServeHTTP(httptest.NewRecorder(), r)
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+		hbs.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL,
+		DegradedInterval: time.Second, ServerTimeout: 9 * time.Second}
+	drop = 2
+	client.DoBeat(context.Background())
+	if err := client.DoBeat(context.Background()); err == nil || !client.Degraded() {
+		t.Fatalf("expect a degraded client after the lost reply, got %v", err)
+	}
+	if err := client.DoBeat(context.Background()); err == nil || !strings.Contains(err.Error(), "messageMAC replayed") {
+		t.Fatalf("expect the retry to be seen as replayed, got %v", err)
+	}
+	if client.Degraded() {
+		t.Fatal("a replayed beat should not be retried with the same timestamp")
+	}
+	// the retry come DegradedInterval later, so does the new server timestamp
+	hbs.Clock = func() time.Time { return start.Add(time.Second) }
+	for i := 0; i < 2; i++ {
+		if err := client.DoBeat(context.Background()); err != nil {
+			t.Fatalf("expect a new handshake to recover, got %v", err)
+		}
+	}
+}
+
+func TestTTLCacheBounded(t *testing.T) {
+	c := newTTLCache(cacheShards)
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		c.add(fmt.Sprintf("mac-%d", i), now, now.Add(time.Minute))
+	}
+	if c.add("mac-99", now, now.Add(time.Minute)) {
+		t.Fatal("latest entry should still be remembered")
+	}
+	st := c.stats()
+	if st.Size > st.Capacity || st.Hits != 1 || st.Evictions == 0 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	c.clear()
+	if c.stats().Size != 0 {
+		t.Fatal("cache should be empty after clear")
+	}
+}
+
+func TestShardRedirect(t *testing.T) {
+	preferred := httptest.NewServer(NewServer("kitty", 4*time.Second))
+	defer preferred.Close()
+	home := NewServer("kitty", 4*time.Second)
+	home.ShardFunc = func(identifier string) string {
+		return preferred.URL
+	}
+	ts := httptest.NewServer(home)
+	defer ts.Close()
+
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL}
+	if err := client.DoBeat(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if client.Endpoint() != preferred.URL {
+		t.Fatalf("client should follow redirect, endpoint %s", client.Endpoint())
+	}
+	if err := client.DoBeat(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandover(t *testing.T) {
+	src := NewServer("kitty", 4*time.Second)
+	dst := NewServer("kitty", 4*time.Second)
+	disconnected := make(chan string, 1)
+	src.OnDisconnect = func(identifier string) {
+		disconnected <- identifier
+	}
+	target := httptest.NewServer(dst.HandoverHandler())
+	defer target.Close()
+
+	src.mu.Lock()
+	src.startSession("whoami", "127.0.0.1", 4*time.Second)
+	src.mu.Unlock()
+	if err := src.Handover(context.Background(), target.URL); err != nil {
+		t.Fatal(err)
+	}
+	dst.mu.Lock()
+	_, ok := dst.sessions["whoami"]
+	dst.mu.Unlock()
+	if !ok {
+		t.Fatal("session should be handed over")
+	}
+	select {
+	case id := <-disconnected:
+		t.Fatalf("%s should not disconnect on source", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestReplyDeterministic(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.Clock = func() time.Time {
+		return time.Unix(1500000000, 0)
+	}
+	req := httptest.NewRequest("POST", "/", strings.NewReader(url.Values{
+		"identifier": {"whoami"},
+		"messageMAC": {hashIdentifier("", "whoami", "kitty")},
+	}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	hbs.ServeHTTP(rec, req)
+	want := "1500000000 " + hashTimestamp("1500000000", "kitty")
+	if rec.Body.String() != want {
+		t.Fatalf("reply %q, want %q", rec.Body.String(), want)
+	}
+}
+
+func TestDANE(t *testing.T) {
+	ts := httptest.NewTLSServer(NewServer("kitty", 4*time.Second))
+	defer ts.Close()
+	spki := sha256.Sum256(ts.Certificate().RawSubjectPublicKeyInfo)
+	client := &Client{
+		Secret:     "kitty",
+		Identifier: "whoami",
+		ServerAddr: ts.URL,
+		TLSALookup: func(ctx context.Context, host, port string) ([]TLSA, error) {
+			return []TLSA{{Usage: 3, Selector: 1, MatchingType: 1, Data: spki[:]}}, nil
+		},
+	}
+	if err := client.DoBeat(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitConnected(t *testing.T) {
+	ts := httptest.NewServer(NewServer("kitty", 4*time.Second))
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL}
+	stop := client.Beat(time.Second)
+	defer stop()
+	if err := client.WaitConnected(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	wrong := &Client{Secret: "kitty2", Identifier: "whoami", ServerAddr: ts.URL}
+	stop2 := wrong.Beat(time.Second)
+	defer stop2()
+	if err := wrong.WaitConnected(ctx); err == nil || ctx.Err() != nil {
+		t.Fatalf("wrong secret should fail fast, got %v", err)
+	}
+}
+
+func TestByeWindow(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	disconnected := make(chan string, 1)
+	hbs.OnDisconnect = func(identifier string) {
+		disconnected <- identifier
+	}
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL}
+	client.DoBeat(context.Background())
+	client.DoBeat(context.Background())
+	time.Sleep(50 * time.Millisecond)
+	if err := client.Bye(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("bye should disconnect at once")
+	}
+	hbs.updateOrSaveSession("whoami", httptest.NewRequest("POST", "/", nil), nil, 0)
+	if _, n := hbs.PresenceDigest(); n != 0 {
+		t.Fatal("late beat should not reconnect after bye")
+	}
+}
+
+func TestFreezeExpiry(t *testing.T) {
+	hbs := NewServer("kitty", 200*time.Millisecond)
+	disconnected := make(chan string, 1)
+	hbs.OnDisconnect = func(identifier string) {
+		disconnected <- identifier
+	}
+	hbs.mu.Lock()
+	hbs.startSession("whoami", "127.0.0.1", 200*time.Millisecond)
+	hbs.mu.Unlock()
+	hbs.FreezeExpiry()
+	select {
+	case <-disconnected:
+		t.Fatal("session should not expire while frozen")
+	case <-time.After(400 * time.Millisecond):
+	}
+	hbs.UnfreezeExpiry()
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("session should expire after unfreeze")
+	}
+}
+
+func TestCommandAck(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	id, err := hbs.SendCommand("whoami", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL}
+	client.DoBeat(context.Background())
+	client.DoBeat(context.Background())
+	cmds := client.Commands()
+	if len(cmds) != 1 || cmds[0].ID != id || cmds[0].Payload != "reload" {
+		t.Fatalf("unexpected commands %v", cmds)
+	}
+	client.Ack(id)
+	client.DoBeat(context.Background())
+	if len(hbs.PendingCommands("whoami")) != 0 {
+		t.Fatal("acked command should be dropped by server")
+	}
+	if len(client.Commands()) != 0 {
+		t.Fatal("acked command should not come back")
+	}
+}
+
+func TestExpectedRoster(t *testing.T) {
+	hbs := NewServer("kitty", time.Second)
+	hbs.AbsentGrace = 50 * time.Millisecond
+	hbs.RosterInterval = 10 * time.Millisecond
+	absent := make(chan string, 2)
+	hbs.OnAbsent = func(identifier string, since time.Time) {
+		absent <- identifier
+	}
+	hbs.mu.Lock()
+	hbs.startSession("online", "127.0.0.1", time.Second)
+	hbs.mu.Unlock()
+	hbs.SetExpected([]string{"online", "never"})
+	defer hbs.SetExpected(nil)
+	select {
+	case id := <-absent:
+		if id != "never" {
+			t.Fatalf("expect never absent, got %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client never connected should be reported absent")
+	}
+	select {
+	case id := <-absent:
+		t.Fatalf("%s should be reported only once", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if got := hbs.Absent(); len(got) != 1 || got[0] != "never" {
+		t.Fatalf("unexpected absent %v", got)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.OnConnect = func(identifier string, r *http.Request) {
+		t.Errorf("probe should not connect %s", identifier)
+	}
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL, Probe: true}
+	for i := 0; i < 2; i++ {
+		if err := client.DoBeat(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := hbs.SessionInfo("whoami"); ok {
+		t.Fatal("probe should not create a session")
+	}
+	if n := hbs.Probes(); n != 2 {
+		t.Fatalf("expect 2 probes, got %d", n)
+	}
+}
+
+func TestProbeAdmit(t *testing.T) {
+	probe := func(hbs *Server) error {
+		ts := httptest.NewServer(hbs)
+		defer ts.Close()
+		client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL, Probe: true}
+		return client.DoBeat(context.Background())
+	}
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.Block("whoami")
+	if err := probe(hbs); err == nil || !strings.Contains(err.Error(), "identifier blocked") {
+		t.Fatalf("expect the probe of a blocked identifier refused, got %v", err)
+	}
+	hbs = NewServer("kitty", 4*time.Second)
+	hbs.Throttle("whoami", ThrottlePolicy{Rate: 0.001})
+	probe(hbs)
+	if err := probe(hbs); err == nil || !strings.Contains(err.Error(), "identifier throttled") {
+		t.Fatalf("expect the probe of a throttled identifier refused, got %v", err)
+	}
+	hbs = NewServer("kitty", 4*time.Second)
+	hbs.CreditRate, hbs.CreditBurst = 0.001, 1
+	probe(hbs)
+	if err := probe(hbs); err == nil || !strings.Contains(err.Error(), "beat credit exhausted") {
+		t.Fatalf("expect the probe out of credit refused, got %v", err)
+	}
+	if n := hbs.Probes(); n != 1 {
+		t.Fatalf("expect the refused probe not counted, got %d", n)
+	}
+}
+
+func TestProcessSynchronously(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.ProcessSynchronously = true
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL}
+	for i := 0; i < 2; i++ { // handshake, then beat
+		if err := client.DoBeat(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := hbs.SessionInfo("whoami"); !ok {
+		t.Fatal("session should be online when the reply is received")
+	}
+	if !client.Recorded() {
+		t.Fatal("client should see the beat confirmed recorded")
+	}
+	hbs.updateOrSaveSession("whoami", httptest.NewRequest("POST", "/", nil), nil, 0)
+	if n := hbs.Shed()[ShedOutOfOrder]; n != 1 {
+		t.Fatalf("expect the overtaken beat to be shed, got %d", n)
+	}
+}
+
+func TestConnectionInterval(t *testing.T) {
+	hbs := NewServer("kitty", 100*time.Millisecond)
+	intervals := make(chan ConnectionInterval, 1)
+	hbs.OnInterval = func(iv ConnectionInterval) {
+		intervals <- iv
+	}
+	start := time.Now()
+	hbs.updateOrSaveSession("whoami", httptest.NewRequest("POST", "/", nil), nil, 0)
+	select {
+	case iv := <-intervals:
+		if iv.Identifier != "whoami" || iv.Reason != ReasonTimeout {
+			t.Fatalf("unexpected interval %+v", iv)
+		}
+		if iv.Start.Before(start) || iv.Duration() < 100*time.Millisecond || iv.Duration() > 150*time.Millisecond {
+			t.Fatalf("interval should end at the deadline, got %v", iv.Duration())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect an interval on timeout")
+	}
+}
+
+func TestMinBuild(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.4", "1.4.0", 0},
+		{"v1.10.0+abc", "1.9.9", 1},
+		{"1.4.0-rc1", "1.4.0", -1},
+		{"a1b2c3d", "0.1", -1},
+	} {
+		if got := CompareBuilds(c.a, c.b); got != c.want {
+			t.Errorf("CompareBuilds(%q, %q) = %d, expect %d", c.a, c.b, got, c.want)
+		}
+	}
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.MinBuild = "1.4"
+	hbs.ProcessSynchronously = true
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	old := &Client{Secret: "kitty", Identifier: "old", ServerAddr: ts.URL, Build: "1.3.9+abc"}
+	old.DoBeat(context.Background())
+	if err := old.DoBeat(context.Background()); err == nil || permanentError(err) == nil {
+		t.Fatalf("expect old build to be refused for good, got %v", err)
+	}
+	client := &Client{Secret: "kitty", Identifier: "new", ServerAddr: ts.URL, Build: "1.4.1+def"}
+	for i := 0; i < 2; i++ {
+		if err := client.DoBeat(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if builds := hbs.Builds(); builds["1.4.1+def"] != 1 || len(builds) != 1 {
+		t.Fatalf("unexpected builds %v", builds)
+	}
+}
+
+func TestUndrain(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.ProcessSynchronously = true
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL}
+	restart := func() string {
+		extra := url.Values{}
+		hbs.restartExtra(extra)
+		return extra.Get(extraRestart)
+	}
+	client.DoBeat(context.Background())
+	client.DoBeat(context.Background())
+
+	hbs.Drain(5 * time.Second)
+	client.DoBeat(context.Background()) // get the directive
+	client.DoBeat(context.Background()) // acknowledge it
+	if acked, _ := hbs.RestartAcked(); restart() != "5" || acked != 1 {
+		t.Fatalf("expect the restart announced and acknowledged, got %q %d", restart(), acked)
+	}
+	broken := httptest.NewServer(http.NotFoundHandler())
+	defer broken.Close()
+	if err := hbs.Handover(context.Background(), broken.URL); err == nil {
+		t.Fatal("expect the handover to fail")
+	}
+	if acked, _ := hbs.RestartAcked(); restart() != "" || acked != 0 {
+		t.Fatalf("failed handover should cancel the restart, got %q %d", restart(), acked)
+	}
+	if err := client.DoBeat(context.Background()); err != nil {
+		t.Fatalf("server should keep serving after a failed handover, got %v", err)
+	}
+
+	hbs.Drain(5 * time.Second)
+	hbs.Undrain()
+	if restart() != "" {
+		t.Fatal("Undrain should cancel the restart")
+	}
+}
+
+func TestDrainAndMigrate(t *testing.T) {
+	old := NewServer("kitty", 4*time.Second)
+	old.ProcessSynchronously = true
+	oldTS := httptest.NewServer(old)
+	defer oldTS.Close()
+	target := NewServer("kitty", 4*time.Second)
+	target.ProcessSynchronously = true
+	targetTS := httptest.NewServer(target)
+	defer targetTS.Close()
+	connects := 0
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: oldTS.URL}
+	client.OnConnect = func() { connects++ }
+	for i := 0; i < 2; i++ {
+		if err := client.DoBeat(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := make(chan MigrationReport, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		report, err := old.DrainAndMigrate(ctx, targetTS.URL)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- report
+	}()
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 3; i++ { // receive the command, leave, connect to target
+		if err := client.DoBeat(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report := <-done
+	if len(report.Migrated) != 1 || len(report.TimedOut) != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if _, ok := target.SessionInfo("whoami"); !ok {
+		t.Fatal("expect the session on target")
+	}
+	if client.Endpoint() != targetTS.URL || connects != 1 {
+		t.Fatalf("expect the client on target, connected once, got %s %d", client.Endpoint(), connects)
+	}
+}
+
+func TestDrainAndMigrateTimeout(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.ProcessSynchronously = true
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL}
+	for i := 0; i < 2; i++ {
+		if err := client.DoBeat(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		hbs.ReadyHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+		return rec.Code
+	}
+	for i := 0; i < 2; i++ { // the client never beat, the migration time out, twice
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		report, err := hbs.DrainAndMigrate(ctx, "http://target.test")
+		cancel()
+		if err != context.DeadlineExceeded || len(report.TimedOut) != 1 {
+			t.Fatalf("attempt %d: expect the client timed out, got %+v %v", i+1, report, err)
+		}
+		if hbs.isMigrating() || ready() != http.StatusOK {
+			t.Fatalf("attempt %d: timed out migration should leave the node in service", i+1)
+		}
+		if cmds := hbs.PendingCommands("whoami"); len(cmds) != 0 {
+			t.Fatalf("attempt %d: expect the migrate command withdrawn, got %v", i+1, cmds)
+		}
+	}
+	if err := client.DoBeat(context.Background()); err != nil || client.Endpoint() != ts.URL {
+		t.Fatalf("client should stay, got %v %s", err, client.Endpoint())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hbs.DrainAndMigrate(ctx, "http://target.test")
+	time.Sleep(50 * time.Millisecond)
+	hbs.CancelMigration()
+	if hbs.isMigrating() || len(hbs.PendingCommands("whoami")) != 0 {
+		t.Fatal("expect the migration cancelled")
+	}
+}
+
+func TestReplyTransform(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.ReplyTransform = func(signed []byte) []byte {
+		// an intermediary wrapping the body
+		return []byte("trace-id: 42\n" + string(FrameReply(signed)) + "\n<!-- footer -->")
+	}
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL, ReplyExtract: UnframeReply}
+	for i := 0; i < 2; i++ {
+		if err := client.DoBeat(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReplyFooter(t *testing.T) {
+	sg := hmacSigner("kitty")
+	buf := &bytes.Buffer{}
+	writeReply(buf, "1234", sg, nil)
+	if _, extra, err := parseReply(buf.String()+"\n<!-- served by kitty -->\nbye", sg); err != nil || extra != nil {
+		t.Fatalf("footer without extra line should be ignored, got %v %v", extra, err)
+	}
+	buf.Reset()
+	writeReply(buf, "1234", sg, url.Values{"redirect": {"http://b"}})
+	if _, extra, err := parseReply(buf.String()+"\n<!-- served by kitty -->", sg); err != nil || extra.Get("redirect") != "http://b" {
+		t.Fatalf("footer after extra line should be ignored, got %v %v", extra, err)
+	}
+
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.ReplyTransform = func(signed []byte) []byte {
+		return append(signed, "\npowered by kitty"...)
+	}
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL}
+	for i := 0; i < 2; i++ {
+		if err := client.DoBeat(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type callbackMetrics struct {
+	mu        sync.Mutex
+	callbacks []string
+}
+
+func (m *callbackMetrics) IncCounter(name string, labels ...string)          {}
+func (m *callbackMetrics) SetGauge(name string, v float64, labels ...string) {}
+func (m *callbackMetrics) ObserveHistogram(name string, v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if name == MetricCallbackSeconds {
+		m.callbacks = append(m.callbacks, labels[1])
+	}
+}
+
+func TestGapExceededCallback(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	metrics := &callbackMetrics{}
+	hbs.Metrics = metrics
+	hbs.GapThreshold = time.Millisecond
+	var gap time.Duration
+	hbs.OnGapExceeded = func(identifier string, d time.Duration) { gap = d }
+	req := httptest.NewRequest("POST", "/", nil)
+	hbs.updateOrSaveSession("whoami", req, nil, 0)
+	time.Sleep(5 * time.Millisecond)
+	hbs.updateOrSaveSession("whoami", req, nil, 1)
+	if gap < time.Millisecond {
+		t.Fatalf("expect OnGapExceeded called, got %v", gap)
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	for _, name := range metrics.callbacks {
+		if name == "OnGapExceeded" {
+			return
+		}
+	}
+	t.Fatalf("expect OnGapExceeded timed like other callbacks, got %v", metrics.callbacks)
+}
+
+func TestConnectGrace(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.ConnectGrace = 10 * time.Second
+	hbs.TimeoutForIdentifier = func(identifier string) time.Duration {
+		if identifier == "critical" {
+			return 30 * time.Second
+		}
+		return 0
+	}
+	req := httptest.NewRequest("POST", "/", nil)
+	for identifier, want := range map[string]time.Duration{"critical": 30 * time.Second, "other": 10 * time.Second} {
+		hbs.updateOrSaveSession(identifier, req, nil, 0)
+		hbs.mu.Lock()
+		got := hbs.sessions[identifier].armedFor
+		hbs.mu.Unlock()
+		if got != want {
+			t.Fatalf("%s: expect the first interval armed for %v, got %v", identifier, want, got)
+		}
+	}
+}
+
+func TestTimeoutForIdentifier(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	critical := 10 * time.Second
+	hbs.TimeoutForIdentifier = func(identifier string) time.Duration {
+		if identifier == "critical" {
+			return critical
+		}
+		return 0
+	}
+	req := httptest.NewRequest("POST", "/", nil)
+	hbs.updateOrSaveSession("critical", req, nil, 0)
+	hbs.updateOrSaveSession("other", req, nil, 0)
+	if info, _ := hbs.SessionInfo("critical"); info.Timeout != 10*time.Second {
+		t.Fatalf("expect the policy timeout, got %v", info.Timeout)
+	}
+	if info, _ := hbs.SessionInfo("other"); info.Timeout != 4*time.Second {
+		t.Fatalf("expect the server timeout, got %v", info.Timeout)
+	}
+	critical = 20 * time.Second
+	hbs.RefreshTimeouts()
+	if info, _ := hbs.SessionInfo("critical"); info.Timeout != 20*time.Second {
+		t.Fatalf("expect the refreshed timeout, got %v", info.Timeout)
+	}
+}
+
+func TestLastWill(t *testing.T) {
+	hbs := NewServer("kitty", 200*time.Millisecond)
+	hbs.ProcessSynchronously = true
+	wills := make(chan string, 2)
+	hbs.OnLastWill = func(identifier, will string) {
+		wills <- identifier + ":" + will
+	}
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	for _, id := range []string{"vanish", "leave"} {
+		client := &Client{Secret: "kitty", Identifier: id, ServerAddr: ts.URL, LastWill: "offline"}
+		for i := 0; i < 2; i++ {
+			if err := client.DoBeat(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if id == "leave" {
+			if err := client.Bye(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	select {
+	case will := <-wills:
+		if will != "vanish:offline" {
+			t.Fatalf("unexpected will %s", will)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect the will of the timed out session")
+	}
+	select {
+	case will := <-wills:
+		t.Fatalf("graceful bye should not deliver the will, got %s", will)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestCoalesceDisconnect(t *testing.T) {
+	hbs := NewServer("kitty", 100*time.Millisecond)
+	hbs.CoalesceDisconnect = 300 * time.Millisecond
+	var mu sync.Mutex
+	var calls []string
+	hbs.OnConnect = func(identifier string, _ *http.Request) {
+		mu.Lock()
+		calls = append(calls, "connect")
+		mu.Unlock()
+	}
+	hbs.OnDisconnect = func(identifier string) {
+		mu.Lock()
+		calls = append(calls, "disconnect")
+		mu.Unlock()
+	}
+	req := httptest.NewRequest("POST", "/", nil)
+	hbs.updateOrSaveSession("whoami", req, nil, 0)
+	time.Sleep(200 * time.Millisecond) // timed out, disconnect held
+	hbs.updateOrSaveSession("whoami", req, nil, 0)
+	time.Sleep(time.Second) // times out again, reported after the window
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(calls, ",") != "connect,disconnect" {
+		t.Fatalf("expect one continuous session, got %v", calls)
+	}
+}
+
+func TestDumpSessions(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.updateOrSaveSession("whoami", httptest.NewRequest("POST", "/", nil), nil, 0)
+	path := t.TempDir() + "/sessions.json"
+	stop, err := hbs.DumpSessions(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewServer("kitty", 4*time.Second)
+	if err := restored.UnmarshalSessions(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restored.SessionInfo("whoami"); !ok {
+		t.Fatal("expect the dump to hold the session")
+	}
+}
+
+func TestSignalStats(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.SignalBuffer = 4
+	req := httptest.NewRequest("POST", "/", nil)
+	hbs.updateOrSaveSession("whoami", req, nil, 0)
+	hbs.mu.Lock()
+	sess := hbs.sessions["whoami"]
+	for i := 0; i < 10; i++ { // faster than the timer goroutine can take them
+		sess.signal(time.Now(), time.Second)
+	}
+	hbs.mu.Unlock()
+	st := hbs.SignalStats()
+	if st.Buffer != 4 || st.Signals != 10 || st.HighWater > 4 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	if st.Coalesced > 0 && st.HighWater != 4 {
+		t.Fatalf("signals coalesced before the buffer filled: %+v", st)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.Throttle("abuser", ThrottlePolicy{Rate: 0.001, Burst: 1, NoCommands: true})
+	if _, err := hbs.SendCommand("abuser", "hello"); err == nil {
+		t.Fatal("expect commands refused while throttled")
+	}
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		if hbs.admit(w, "abuser"); w.Code != want {
+			t.Fatalf("request %d: expect %d, got %d", i, want, w.Code)
+		}
+	}
+	if throttles := hbs.Throttles(); len(throttles) != 1 || throttles[0].Refused != 1 {
+		t.Fatalf("unexpected throttles %+v", throttles)
+	}
+	hbs.ClearThrottle("abuser")
+	if w := httptest.NewRecorder(); !hbs.admit(w, "abuser") {
+		t.Fatalf("expect admitted once cleared, got %d", w.Code)
+	}
+}
+
+func TestClockBookkeeping(t *testing.T) {
+	hbs := NewServer("kitty", time.Hour)
+	hbs.ProcessSynchronously = true
+	hbs.RejectCadenceViolation = true
+	var mu sync.Mutex
+	now := time.Unix(1500000000, 0)
+	hbs.Clock = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		now = now.Add(d)
+		mu.Unlock()
+	}
+	var events []Event
+	hbs.Watch("whoami", func(ev Event) { events = append(events, ev) })
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL, BeatInterval: time.Minute, AdvertiseInterval: true}
+	for i := 0; i < 4; i++ { // beats a minute apart on the server clock, milliseconds apart in real time
+		if err := client.DoBeat(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		advance(time.Minute)
+	}
+	if n := hbs.CadenceViolations(); n != 0 {
+		t.Fatalf("cadence should follow Clock, got %d violations", n)
+	}
+	if info, _ := hbs.SessionInfo("whoami"); info.Interarrival.Count == 0 || info.Interarrival.Mean < 50*time.Second {
+		t.Fatalf("inter-arrival should follow Clock, got %+v", info.Interarrival)
+	}
+	// the handshake at the start, a minute later the first beat connect
+	if len(events) == 0 || events[0].Type != EventConnect || !events[0].Time.Equal(time.Unix(1500000060, 0)) {
+		t.Fatalf("event time should follow Clock, got %+v", events)
+	}
+}
+
+func TestKeyWindow(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.KeyWindow = time.Minute
+	now := time.Now()
+	hbs.Clock = func() time.Time { return now }
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL, KeyWindow: time.Minute}
+	if err := client.DoBeat(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	plain := &Client{Secret: "kitty", Identifier: "plain", ServerAddr: ts.URL}
+	if err := plain.DoBeat(context.Background()); err == nil {
+		t.Fatal("expect the plain secret refused")
+	}
+	// client clock one window ahead is tolerated, two are not
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	for skew, want := range map[int64]bool{1: true, 2: false} {
+		key := windowKey("kitty", keyWindowOf(now, time.Minute)+skew)
+		if _, ok := hbs.matchKey(timestamp, "whoami", "kitty", hashIdentifier(timestamp, "whoami", key)); ok != want {
+			t.Fatalf("skew %d windows: expect %v", skew, want)
+		}
+	}
+}
+
+func TestRejectedBeats(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.RejectionAudit = 2
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	for _, id := range []string{"a", "b", "c"} {
+		client := &Client{Secret: "wrong", Identifier: id, ServerAddr: ts.URL}
+		if err := client.DoBeat(context.Background()); err == nil {
+			t.Fatal("expect wrong secret to be rejected")
+		}
+	}
+	rejected := hbs.RejectedBeats()
+	if len(rejected) != 2 || rejected[0].Identifier != "b" || rejected[1].Identifier != "c" {
+		t.Fatalf("expect the last 2 rejections, got %+v", rejected)
+	}
+	if rejected[1].Status < 400 || rejected[1].Reason == "" {
+		t.Fatalf("expect status and reason, got %+v", rejected[1])
+	}
+	if len(rejected[1].MAC) > redactedMACLen+3 {
+		t.Fatalf("MAC not redacted: %s", rejected[1].MAC)
+	}
+}
+
+func TestDisconnectOnClose(t *testing.T) {
+	hbs := NewServer("kitty", 10*time.Second)
+	hbs.DisconnectOnClose = true
+	watched := make(chan Event, 4)
+	hbs.Watch("whoami", func(ev Event) {
+		watched <- ev
+	})
+	ts := httptest.NewUnstartedServer(hbs)
+	ts.Config.ConnContext = hbs.ConnContext
+	ts.Config.ConnState = hbs.ConnState
+	ts.Start()
+	defer ts.Close()
+	transport := &http.Transport{}
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL, Transport: transport}
+	client.DoBeat(context.Background())
+	client.DoBeat(context.Background())
+	if ev := <-watched; ev.Type != EventConnect {
+		t.Fatalf("expect connect, got %v", ev.Type)
+	}
+	transport.CloseIdleConnections()
+	select {
+	case ev := <-watched:
+		if ev.Type != EventDisconnect || ev.Reason != ReasonConnectionClosed {
+			t.Fatalf("unexpected event %v %s", ev.Type, ev.Reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("session should be disconnected on connection close")
+	}
+}
+
+func TestShutdownExport(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.OnDisconnect = func(identifier string) {
+		t.Errorf("shutdown should not disconnect %s", identifier)
+	}
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL}
+	client.DoBeat(context.Background())
+	client.DoBeat(context.Background())
+	data, err := hbs.ShutdownExport(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var states []SessionState
+	if err := json.Unmarshal(data, &states); err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 || states[0].Identifier != "whoami" {
+		t.Fatalf("unexpected export %s", data)
+	}
+	if err := client.DoBeat(context.Background()); err == nil {
+		t.Fatal("beat should be refused after shutdown")
+	}
+}
+
+func TestEd25519(t *testing.T) {
+	clientPub, clientKey, _ := ed25519.GenerateKey(nil)
+	serverPub, serverKey, _ := ed25519.GenerateKey(nil)
+	keys := map[string]ed25519.PublicKey{"whoami": clientPub}
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.PublicKeyFunc = func(identifier string) (ed25519.PublicKey, error) {
+		return keys[identifier], nil
+	}
+	hbs.SigningKey = serverKey
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	client := &Client{Identifier: "whoami", ServerAddr: ts.URL, SigningKey: clientKey, ServerKey: serverPub}
+	for i := 0; i < 2; i++ {
+		if err := client.DoBeat(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	delete(keys, "whoami")
+	if err := client.DoBeat(context.Background()); err == nil || !strings.Contains(err.Error(), "signature wrong") {
+		t.Fatalf("removed key should be rejected, got %v", err)
+	}
+}
+
+func TestEd25519RefuseSecret(t *testing.T) {
+	clientPub, clientKey, _ := ed25519.GenerateKey(nil)
+	revoked := map[string]bool{}
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.PublicKeyFunc = func(identifier string) (ed25519.PublicKey, error) {
+		if revoked[identifier] {
+			return nil, ErrKeyRevoked
+		}
+		if identifier == "keyed" {
+			return clientPub, nil
+		}
+		return nil, nil
+	}
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	forged := &Client{Secret: "kitty", Identifier: "keyed", ServerAddr: ts.URL}
+	if err := forged.DoBeat(context.Background()); err == nil || !strings.Contains(err.Error(), "signature required") {
+		t.Fatalf("HMAC beat of a keyed identifier should be rejected, got %v", err)
+	}
+	plain := &Client{Secret: "kitty", Identifier: "plain", ServerAddr: ts.URL}
+	if err := plain.DoBeat(context.Background()); err != nil {
+		t.Fatalf("identifier without key should keep the secret, got %v", err)
+	}
+
+	revoked["keyed"] = true
+	signer := &Client{Identifier: "keyed", ServerAddr: ts.URL, SigningKey: clientKey}
+	for _, client := range []*Client{signer, forged} {
+		if err := client.DoBeat(context.Background()); err == nil || !strings.Contains(err.Error(), "key revoked") {
+			t.Fatalf("beat after revocation should be rejected, got %v", err)
+		}
+	}
+
+	hbs.RequireSignature = true
+	if err := plain.DoBeat(context.Background()); err == nil || !strings.Contains(err.Error(), "signature required") {
+		t.Fatalf("RequireSignature should refuse the secret, got %v", err)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	ns := NewNamespaces()
+	chat := NewServer("kitty", 4*time.Second)
+	jobs := NewServer("doggy", 4*time.Second)
+	ns.Handle("chat", chat)
+	ns.Handle("jobs", jobs)
+	ts := httptest.NewServer(ns)
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL + "/chat"}
+	if err := client.DoBeat(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	wrong := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL + "/jobs"}
+	if err := wrong.DoBeat(context.Background()); err == nil {
+		t.Fatal("secret of chat should not work for jobs")
+	}
+	unknown := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL + "/nope"}
+	if err := unknown.DoBeat(context.Background()); err == nil {
+		t.Fatal("unknown namespace should be refused")
+	}
+}
+
+func TestBeatCredits(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.CreditRate = 0.01
+	hbs.CreditBurst = 3
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL}
+	for i := 0; i < 3; i++ {
+		if err := client.DoBeat(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.DoBeat(context.Background()); err == nil || !strings.Contains(err.Error(), "credit") {
+		t.Fatalf("expect out of credit, got %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if info, ok := hbs.SessionInfo("whoami"); !ok || info.Credits >= 1 {
+		t.Fatalf("unexpected credits %v %v", info.Credits, ok)
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.ReadyCacheTTL = 10 * time.Millisecond
+	hbs.RejectUnready = true
+	var storeErr error
+	var mu sync.Mutex
+	hbs.ReadyFunc = func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return storeErr
+	}
+	ready := httptest.NewServer(hbs.ReadyHandler())
+	defer ready.Close()
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL}
+	if err := client.DoBeat(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	storeErr = errors.New("store down")
+	mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	ready.Client().Get(ready.URL) // refresh the cache
+	resp, err := ready.Client().Get(ready.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expect 503, got %d", resp.StatusCode)
+	}
+	if err := client.DoBeat(context.Background()); err == nil {
+		t.Fatal("beat should be refused while not ready")
+	}
+}
+
+func TestReconnectResume(t *testing.T) {
+	hbs := NewServer("kitty", 100*time.Millisecond)
+	hbs.ReconnectPolicy = &ReconnectPolicy{
+		AfterTimeout: ReconnectRule{Window: time.Second, Action: ReconnectResume},
+	}
+	connects, reconnects := make(chan string, 2), make(chan string, 2)
+	hbs.OnConnect = func(identifier string, r *http.Request) {
+		connects <- identifier
+	}
+	hbs.OnReconnect = func(identifier string, r *http.Request) {
+		reconnects <- identifier
+	}
+	disconnected := make(chan string, 1)
+	hbs.OnDisconnect = func(identifier string) {
+		disconnected <- identifier
+	}
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL}
+	client.DoBeat(context.Background())
+	client.DoBeat(context.Background())
+	<-connects
+	<-disconnected
+	// the timestamp may have gone stale past a second boundary, then it take a new handshake
+	client.DoBeat(context.Background())
+	for i := 0; i < 2 && !client.Connected(); i++ {
+		client.DoBeat(context.Background())
+	}
+	select {
+	case <-reconnects:
+	case <-connects:
+		t.Fatal("beat within the window should resume, not connect")
+	case <-time.After(time.Second):
+		t.Fatal("expect OnReconnect")
+	}
+}
+
+func TestCadenceBackoff(t *testing.T) {
+	hbs := NewServer("kitty", 10*time.Second)
+	hbs.RequireAdvertisedInterval = true
+	client := &Client{Secret: "kitty", Identifier: "whoami"}
+	if rate := beatRate(hbs, client, 50*time.Millisecond, time.Second); rate > 3 {
+		t.Fatalf("client not advertising should back off, got %.0f requests/s", rate)
+	}
+
+	hbs = NewServer("kitty", 10*time.Second)
+	hbs.ProcessSynchronously = true
+	hbs.RejectCadenceViolation = true
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	client = &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL, BeatInterval: 2 * time.Second, AdvertiseInterval: true}
+	for i := 0; i < 3; i++ { // the handshake, then the beats starting the session and the cadence
+		client.DoBeat(context.Background())
+	}
+	// called early by its host, the beat arrive within the advertised interval
+	if err := client.DoBeat(context.Background()); err == nil || !strings.Contains(err.Error(), "beat faster") {
+		t.Fatalf("expect a cadence violation, got %v", err)
+	}
+	if next := client.NextBeatAfter(); next < 500*time.Millisecond {
+		t.Fatalf("expect to wait for the Retry-After, got %v", next)
+	}
+	if rate := beatRate(hbs, client, 2*time.Second, time.Second); rate > 5 {
+		t.Fatalf("violating client should back off, got %.0f requests/s", rate)
+	}
+}
+
+func TestStatusVersionRefusedAtHandshake(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.StatusVersionPolicy = func(version int) error {
+		if version != 2 {
+			return errors.New("want 2")
+		}
+		return nil
+	}
+	client := &Client{Secret: "kitty", Identifier: "whoami"}
+	client.SetStatus(1, `{"cpu":1}`)
+	if rate := beatRate(hbs, client, 50*time.Millisecond, time.Second); rate > 3 {
+		t.Fatalf("refused client should back off, got %.0f requests/s", rate)
+	}
+	if _, ok := hbs.SessionInfo("whoami"); ok {
+		t.Fatal("refused client should not start a session")
+	}
+}
+
+func TestWillTooLargeAtHandshake(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	client := &Client{Secret: "kitty", Identifier: "whoami", LastWill: strings.Repeat("x", maxWillBytes+1)}
+	if rate := beatRate(hbs, client, 50*time.Millisecond, time.Second); rate > 3 {
+		t.Fatalf("refused client should back off, got %.0f requests/s", rate)
+	}
+	if _, ok := hbs.SessionInfo("whoami"); ok {
+		t.Fatal("refused client should not start a session")
+	}
+}
+
+func TestAuthFuncChecks(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.ProcessSynchronously = true
+	hbs.AuthFunc = func(r *http.Request) (string, bool, error) {
+		return r.Header.Get("X-Token"), true, nil
+	}
+	hbs.RequireAdvertisedInterval = true
+	hbs.MinBuild = "1.4"
+	hbs.StatusVersionPolicy = func(version int) error {
+		if version != 2 {
+			return errors.New("want 2")
+		}
+		return nil
+	}
+	hbs.LastConnectionWins = true
+	hbs.FingerprintFunc = func(r *http.Request) string { return r.Header.Get("X-Device") }
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	beat := func(device, extra string) (int, string) {
+		req, _ := newBeatRequest(ts.URL, url.Values{"extra": {extra}})
+		req.Header.Set("X-Token", "whoami")
+		req.Header.Set("X-Device", device)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	for _, tc := range []struct {
+		extra, err string
+		code       int
+	}{
+		{"build=1.5&statusVersion=2", "interval not advertised", http.StatusBadRequest},
+		{"interval=1000&build=1.3&statusVersion=2", "build below minimum", http.StatusForbidden},
+		{"interval=1000&statusVersion=2", "build required", http.StatusBadRequest},
+		{"interval=1000&build=1.5&statusVersion=1", "status version", http.StatusBadRequest},
+	} {
+		if code, body := beat("a", tc.extra); code != tc.code || !strings.Contains(body, tc.err) {
+			t.Fatalf("%s: expect %d %q, got %d %q", tc.extra, tc.code, tc.err, code, body)
+		}
+	}
+	if _, ok := hbs.SessionInfo("whoami"); ok {
+		t.Fatal("refused beats should not start a session")
+	}
+	good := "interval=1000&build=1.5&statusVersion=2"
+	if code, body := beat("a", good); code != http.StatusOK {
+		t.Fatalf("expect the beat accepted, got %d %q", code, body)
+	}
+	if info, ok := hbs.SessionInfo("whoami"); !ok || info.Build != "1.5" {
+		t.Fatalf("expect the session with its build, got %+v", info)
+	}
+
+	if code, _ := beat("b", good); code != http.StatusOK {
+		t.Fatalf("expect device b to take over, got %d", code)
+	}
+	if code, body := beat("a", good); code != http.StatusConflict || !strings.Contains(body, "session superseded") {
+		t.Fatalf("expect the superseded device refused, got %d %q", code, body)
+	}
+}
+
+// beatRate run client.Beat(interval) against hbs for d, return the requests hbs received per second
+func beatRate(hbs *Server, client *Client, interval, d time.Duration) float64 {
+	var requests int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		hbs.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	client.ServerAddr = ts.URL
+	cancel := client.Beat(interval)
+	time.Sleep(d)
+	cancel()
+	return float64(atomic.LoadInt64(&requests)) / d.Seconds()
+}
+
+func TestRejectBackoff(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL, BeatInterval: 10 * time.Second}
+	client.DoBeat(context.Background())
+	hbs.Block("whoami") // the beat after the handshake is refused, it used to reconnect at once
+	want := 10 * time.Second
+	for i := 0; i < 4; i++ {
+		client.DoBeat(context.Background())
+		if next := client.NextBeatAfter(); next < want {
+			t.Fatalf("rejection %d: expect a wait of at least %v, got %v", i+1, want, next)
+		}
+		want *= 2
+	}
+	if d := rejectBackoff(time.Second, 100); d < maxRejectBackoff || d > maxRejectBackoff+maxRejectBackoff/4 {
+		t.Fatalf("backoff should be capped, got %v", d)
+	}
+
+	hbs = NewServer("kitty", 4*time.Second)
+	hbs.MinBuild = "2.0"
+	client = &Client{Secret: "kitty", Identifier: "whoami", Build: "1.0"}
+	if rate := beatRate(hbs, client, 50*time.Millisecond, time.Second); rate > 20 {
+		t.Fatalf("refused client should back off, got %.0f requests/s", rate)
+	}
+}
+
+func TestBusyRetryAfter(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.MaxWorkers, hbs.WorkQueue = 1, 1
+	release := make(chan struct{})
+	for { // fill the worker and its queue
+		hbs.dispatch(func() { <-release })
+		if busy, queued, _ := hbs.Workers(); busy == 1 && queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	defer close(release)
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL, BeatInterval: 100 * time.Millisecond}
+	client.DoBeat(context.Background())
+	if err := client.DoBeat(context.Background()); err == nil || !strings.Contains(err.Error(), "server busy") {
+		t.Fatalf("expect server busy, got %v", err)
+	}
+	if next := client.NextBeatAfter(); next < retryAfterBusy || next > retryAfterBusy+retryAfterBusy/4 {
+		t.Fatalf("expect the client to wait the Retry-After, got %v", next)
+	}
+
+	// without Retry-After, about the beat interval
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	client = &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: unavailable.URL, BeatInterval: 10 * time.Second}
+	client.timeKey = "1234" // a beat, not a handshake, used to reconnect at once
+	client.DoBeat(context.Background())
+	if next := client.NextBeatAfter(); next < 10*time.Second {
+		t.Fatalf("expect the client to back off on 503, got %v", next)
+	}
+}
+
+func TestGroupQuotaHandshake(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.ProcessSynchronously = true
+	hbs.DefaultGroupQuota = GroupQuota{MaxSessions: 1}
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	first := &Client{Secret: "kitty", Identifier: "first", ServerAddr: ts.URL}
+	first.DoBeat(context.Background())
+	if err := first.DoBeat(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := BuildBeatRequest(ts.URL, "second", "kitty", "", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "4" {
+		t.Fatalf("expect the handshake refused with Retry-After, got %d %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	second := &Client{Secret: "kitty", Identifier: "second"}
+	if rate := beatRate(hbs, second, 50*time.Millisecond, time.Second); rate > 3 {
+		t.Fatalf("client over the quota should back off, got %.0f requests/s", rate)
+	}
+}
+
+func TestBuildRefusedAtHandshake(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.MinBuild = "2.0"
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL, Build: "1.0"}
+	if err := client.DoBeat(context.Background()); err == nil || !strings.Contains(err.Error(), "build below minimum") {
+		t.Fatalf("expect the handshake refused, got %v", err)
+	}
+	for _, tc := range []struct {
+		minBuild, build string
+		require         bool
+	}{{"2.0", "1.0", false}, {"", "", true}} {
+		hbs := NewServer("kitty", 4*time.Second)
+		hbs.MinBuild, hbs.RequireBuild = tc.minBuild, tc.require
+		client := &Client{Secret: "kitty", Identifier: "whoami", Build: tc.build}
+		if rate := beatRate(hbs, client, 50*time.Millisecond, time.Second); rate > 3 {
+			t.Fatalf("MinBuild %q RequireBuild %v: refused client should back off, got %.0f requests/s", tc.minBuild, tc.require, rate)
+		}
+	}
+}
+
+func TestBlock(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.ProcessSynchronously = true
+	disconnects := make(chan string, 4)
+	hbs.OnDisconnect = func(identifier string) { disconnects <- identifier }
+	reasons := make(chan DisconnectReason, 4)
+	hbs.Watch("whoami", func(ev Event) {
+		if ev.Type == EventDisconnect {
+			reasons <- ev.Reason
+		}
+	})
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL}
+	client.DoBeat(context.Background())
+	if err := client.DoBeat(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	hbs.Block("whoami")
+	if _, ok := hbs.SessionInfo("whoami"); ok {
+		t.Fatal("blocked identifier should be disconnected")
+	}
+	select {
+	case id := <-disconnects:
+		if id != "whoami" {
+			t.Fatalf("unexpected disconnect of %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect OnDisconnect for the blocked session")
+	}
+	select {
+	case reason := <-reasons:
+		if reason != ReasonBlocked {
+			t.Fatalf("expect ReasonBlocked, got %v", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expect a disconnect event")
+	}
+	if got := hbs.Blocked(); len(got) != 1 || got[0] != "whoami" {
+		t.Fatalf("unexpected blocklist %v", got)
+	}
+
+	req, _ := BuildBeatRequest(ts.URL, "whoami", "kitty", "", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(string(body), "identifier blocked") {
+		t.Fatalf("expect 403 for a blocked identifier, got %d %q", resp.StatusCode, body)
+	}
+
+	hbs.Unblock("whoami")
+	client = &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL}
+	if err := client.DoBeat(context.Background()); err != nil {
+		t.Fatalf("unblocked identifier should connect again, got %v", err)
+	}
+}
+
+func TestLastConnectionWins(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.LastConnectionWins = true
+	hbs.FingerprintFunc = func(r *http.Request) string {
+		return r.Header.Get("X-Device")
+	}
+	superseded := make(chan string, 4)
+	hbs.Watch("whoami", func(ev Event) {
+		if ev.Type == EventDisconnect && ev.Reason == ReasonSuperseded {
+			superseded <- ev.Identifier
+		}
+	})
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	device := func(name string) *Client {
+		return &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL,
+			RequestOptions: RequestOptions{Header: http.Header{"X-Device": {name}}}}
+	}
+	waitOnline := func() {
+		for i := 0; i < 100; i++ {
+			if _, ok := hbs.SessionInfo("whoami"); ok {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatal("session should be online")
+	}
+	a := device("a")
+	a.DoBeat(context.Background())
+	a.DoBeat(context.Background())
+	waitOnline()
+
+	// b and c take over concurrently, exactly one of them must remain
+	b, c := device("b"), device("c")
+	var wg sync.WaitGroup
+	for _, cl := range []*Client{b, c} {
+		wg.Add(1)
+		go func(cl *Client) {
+			defer wg.Done()
+			cl.DoBeat(context.Background())
+			cl.DoBeat(context.Background())
+		}(cl)
+	}
+	wg.Wait()
+	time.Sleep(50 * time.Millisecond)
+	if err := a.DoBeat(context.Background()); err == nil || !strings.Contains(err.Error(), "superseded") {
+		t.Fatalf("kicked device should be refused, got %v", err)
+	}
+	bErr, cErr := b.DoBeat(context.Background()), c.DoBeat(context.Background())
+	if (bErr == nil) == (cErr == nil) {
+		t.Fatalf("exactly one device should win, got %v and %v", bErr, cErr)
+	}
+	if n := len(superseded); n < 1 {
+		t.Fatalf("expect superseded disconnects, got %d", n)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.mu.Lock()
+	hbs.startSession("whoami", "127.0.0.1", 4*time.Second)
+	hbs.mu.Unlock()
+	st := hbs.MemoryStats()
+	if st.Sessions.Entries != 1 || st.Total <= 0 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	hbs.MemoryBudget = 1
+	if _, err := hbs.SendCommand("whoami", "reload"); err == nil {
+		t.Fatal("command should be refused over budget")
+	}
+	if !hbs.MemoryStats().OverBudget {
+		t.Fatal("expect over budget")
+	}
+}
+
+// fakeClock is a Server.Clock and Server.NewTimer, the time only move with Advance
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers fakeTimers
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1500000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1), index: -1}
+	t.Reset(d)
+	return t
+}
+
+// Advance move the clock by d and fire the timers due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for len(c.timers) > 0 && !c.timers[0].at.After(c.now) {
+		t := heap.Pop(&c.timers).(*fakeTimer)
+		select {
+		case t.c <- c.now:
+		default:
+		}
+	}
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	c     chan time.Time
+	at    time.Time
+	index int // in clock.timers, -1 when not armed
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.index >= 0
+	t.at = t.clock.now.Add(d)
+	if active {
+		heap.Fix(&t.clock.timers, t.index)
+	} else {
+		heap.Push(&t.clock.timers, t)
+	}
+	return active
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.index >= 0
+	if active {
+		heap.Remove(&t.clock.timers, t.index)
+	}
+	return active
+}
+
+// fakeTimers is a heap of the armed timers, the next to fire first
+type fakeTimers []*fakeTimer
+
+func (h fakeTimers) Len() int           { return len(h) }
+func (h fakeTimers) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h fakeTimers) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *fakeTimers) Push(x interface{}) {
+	t := x.(*fakeTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *fakeTimers) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	*h, t.index = old[:len(old)-1], -1
+	return t
+}
+
+var scaleSessions = flag.Int("sessions", 20000, "virtual sessions of TestExpiryAtScale, try 1000000")
+
+// sessionTimeout spread the timeouts of virtual sessions over 50ms ~ 249ms, by 1ms
+func sessionTimeout(n int) time.Duration {
+	return 50*time.Millisecond + time.Duration(n%200)*time.Millisecond
+}
+
+func sessionTimeouts(identifier string) time.Duration {
+	var n int
+	fmt.Sscanf(identifier, "s%d", &n)
+	return sessionTimeout(n)
+}
+
+// TestExpiryAtScale start -sessions virtual sessions with varied timeouts on a fake clock, then move
+// the clock 1ms at a time and check each step expire exactly the sessions due, at that very time,
+// and every session expire exactly once. Each session run its own timer goroutine (there is no
+// shared timing wheel), so the scale is bounded by goroutine memory, about sessionGoroutine bytes
+// per session: a million sessions take about 4GB and 20s on one core.
+func TestExpiryAtScale(t *testing.T) {
+	n := *scaleSessions
+	if testing.Short() && n > 2000 {
+		n = 2000
+	}
+	clock := newFakeClock()
+	hbs := NewServer("kitty", time.Second)
+	hbs.Clock, hbs.NewTimer = clock.Now, clock.NewTimer
+	hbs.TimeoutForIdentifier = sessionTimeouts
+	fired := make([]int32, n)
+	var total, wrong int64
+	hbs.OnInterval = func(iv ConnectionInterval) {
+		var i int
+		fmt.Sscanf(iv.Identifier, "s%d", &i)
+		atomic.AddInt32(&fired[i], 1)
+		if !clock.Now().Equal(iv.Start.Add(sessionTimeout(i))) {
+			atomic.AddInt64(&wrong, 1)
+		}
+		atomic.AddInt64(&total, 1)
+	}
+	req := httptest.NewRequest("POST", "/", nil)
+	due := make([]int64, 250) // sessions expired once the clock moved by index ms
+	for i := 0; i < n; i++ {
+		hbs.updateOrSaveSession(fmt.Sprintf("s%d", i), req, nil, 0)
+		due[sessionTimeout(i)/time.Millisecond]++
+	}
+	for ms := 1; ms < len(due); ms++ {
+		due[ms] += due[ms-1]
+		clock.Advance(time.Millisecond)
+		deadline := time.Now().Add(10 * time.Second)
+		for atomic.LoadInt64(&total) < due[ms] {
+			if time.Now().After(deadline) {
+				t.Fatalf("at %dms only %d of %d sessions expired", ms, atomic.LoadInt64(&total), due[ms])
+			}
+			time.Sleep(100 * time.Microsecond)
+		}
+		if got := atomic.LoadInt64(&total); got != due[ms] {
+			t.Fatalf("at %dms %d sessions expired, expect %d", ms, got, due[ms])
+		}
+	}
+	clock.Advance(time.Second)
+	time.Sleep(10 * time.Millisecond)
+	for i := range fired {
+		if c := atomic.LoadInt32(&fired[i]); c != 1 {
+			t.Fatalf("s%d expired %d times", i, c)
+		}
+	}
+	if wrong > 0 {
+		t.Fatalf("%d sessions did not expire at their deadline", wrong)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	var mu sync.Mutex
+	var records []AccessRecord
+	hbs.AccessLog = func(rec AccessRecord) {
+		mu.Lock()
+		records = append(records, rec)
+		mu.Unlock()
+	}
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL}
+	for i := 0; i < 2; i++ {
+		if err := client.DoBeat(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wrong := &Client{Secret: "other", Identifier: "intruder", ServerAddr: ts.URL}
+	wrong.DoBeat(context.Background())
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(records) != 3 {
+		t.Fatalf("expect one record per request, got %+v", records)
+	}
+	for _, rec := range records[:2] {
+		if rec.Identifier != "whoami" || rec.Status != http.StatusOK || rec.Reason != "" ||
+			rec.Latency <= 0 || rec.RemoteAddr != "127.0.0.1" {
+			t.Fatalf("unexpected record of an accepted request %+v", rec)
+		}
+	}
+	if rec := records[2]; rec.Identifier != "intruder" || rec.Status != http.StatusBadRequest || rec.Reason != "messageMAC wrong" {
+		t.Fatalf("unexpected record of a rejected request %+v", rec)
+	}
+}
+
+func TestReplyFunc(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	reply := map[string]string{"flag": "on", "redirect": "http://elsewhere.test"}
+	hbs.ReplyFunc = func(identifier string) map[string]string {
+		if identifier != "whoami" {
+			t.Errorf("unexpected identifier %s", identifier)
+		}
+		return reply
+	}
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	var got []map[string]string
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL,
+		OnReply: func(extra map[string]string) { got = append(got, extra) }}
+	for i := 0; i < 2; i++ {
+		if err := client.DoBeat(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != 2 || got[1]["flag"] != "on" || got[1]["redirect"] != "http://elsewhere.test" {
+		t.Fatalf("expect the reply extra of each beat, got %v", got)
+	}
+	if client.Endpoint() != ts.URL {
+		t.Fatalf("user keys should not act as directives, endpoint %s", client.Endpoint())
+	}
+
+	reply = map[string]string{"big": strings.Repeat("x", maxUserExtra)}
+	got = nil
+	if err := client.DoBeat(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("expect the oversize reply extra dropped, got %v", got)
+	}
+}
+
+func TestEventOverflow(t *testing.T) {
+	emit := func(hbs *Server, identifiers ...string) {
+		for _, id := range identifiers {
+			hbs.mu.Lock()
+			hbs.emit(EventConnect, &Session{identifier: id})
+			hbs.mu.Unlock()
+		}
+	}
+	drain := func(events <-chan Event) (ids []string) {
+		for {
+			select {
+			case ev := <-events:
+				ids = append(ids, ev.Identifier)
+			default:
+				return ids
+			}
+		}
+	}
+	for _, tc := range []struct {
+		policy OverflowPolicy
+		want   string
+	}{{DropNewest, "a b"}, {DropOldest, "b c"}} {
+		hbs := NewServer("kitty", 4*time.Second)
+		hbs.EventBuffer, hbs.EventOverflow = 2, tc.policy
+		events := hbs.Events()
+		emit(hbs, "a", "b", "c")
+		if got := strings.Join(drain(events), " "); got != tc.want || hbs.DroppedEvents() != 1 {
+			t.Fatalf("policy %d: expect %q and 1 dropped, got %q and %d", tc.policy, tc.want, got, hbs.DroppedEvents())
+		}
+	}
+
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.EventBuffer, hbs.EventOverflow = 1, Block
+	events := hbs.Events()
+	done := make(chan struct{})
+	go func() {
+		emit(hbs, "a", "b")
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("expect the second event to wait for the consumer")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if ev := <-events; ev.Identifier != "a" {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+	<-done
+	if ev := <-events; ev.Identifier != "b" || hbs.DroppedEvents() != 0 {
+		t.Fatalf("expect nothing dropped with Block, got %+v and %d", ev, hbs.DroppedEvents())
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.ProcessSynchronously = true
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL}
+	for i := 0; i < 2; i++ {
+		if err := client.DoBeat(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hbs.Reconfigure("puppy", 8*time.Second, false)
+	if secret, timeout := hbs.config(); secret != "puppy" || timeout != 8*time.Second {
+		t.Fatalf("expect both updated, got %q %v", secret, timeout)
+	}
+	if err := client.DoBeat(context.Background()); err == nil || !strings.Contains(err.Error(), "messageMAC wrong") {
+		t.Fatalf("expect the old secret refused, got %v", err)
+	}
+	if info, ok := hbs.SessionInfo("whoami"); !ok || info.Timeout != 4*time.Second {
+		t.Fatalf("existing session should keep its timeout, got %+v", info)
+	}
+	other := &Client{Secret: "puppy", Identifier: "other", ServerAddr: ts.URL}
+	for i := 0; i < 2; i++ {
+		if err := other.DoBeat(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if info, _ := hbs.SessionInfo("other"); info.Timeout != 8*time.Second {
+		t.Fatalf("new session should use the new timeout, got %v", info.Timeout)
+	}
+	hbs.Reconfigure("puppy", 12*time.Second, true)
+	for _, id := range []string{"whoami", "other"} {
+		if info, _ := hbs.SessionInfo(id); info.Timeout != 12*time.Second {
+			t.Fatalf("%s: expect rearmed with the new timeout, got %v", id, info.Timeout)
+		}
+	}
+}
+
+func TestAnonymizeFunc(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.ProcessSynchronously = true
+	hbs.AnonymizeFunc = func(identifier string) string {
+		sum := sha256.Sum256([]byte(identifier))
+		return fmt.Sprintf("%x", sum[:4])
+	}
+	anon := hbs.AnonymizeFunc("whoami")
+	var mu sync.Mutex
+	var logged []string
+	hbs.AccessLog = func(rec AccessRecord) {
+		mu.Lock()
+		logged = append(logged, rec.Identifier)
+		mu.Unlock()
+	}
+	hbs.RejectionAudit = 4
+	hbs.ReplyFunc = func(string) map[string]string {
+		return map[string]string{"big": strings.Repeat("x", maxUserExtra)}
+	}
+	buf := &bytes.Buffer{}
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(buf)
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL}
+	for i := 0; i < 2; i++ {
+		if err := client.DoBeat(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hbs.Block("whoami")
+	client.DoBeat(context.Background())
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, id := range logged {
+		if id != anon {
+			t.Fatalf("expect the access log anonymized, got %v", logged)
+		}
+	}
+	if rejected := hbs.RejectedBeats(); len(rejected) != 1 || rejected[0].Identifier != anon {
+		t.Fatalf("expect the audit anonymized, got %+v", rejected)
+	}
+	if strings.Contains(buf.String(), "whoami") || !strings.Contains(buf.String(), anon) {
+		t.Fatalf("expect the log anonymized, got %q", buf.String())
+	}
+	if blocked := hbs.Blocked(); len(blocked) != 1 || blocked[0] != "whoami" {
+		t.Fatalf("sessions and blocklist keep the real identifier, got %v", blocked)
+	}
+}
+
+type counterMetrics struct {
+	mu       sync.Mutex
+	counters map[string]int
+}
+
+func (m *counterMetrics) IncCounter(name string, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counters == nil {
+		m.counters = make(map[string]int)
+	}
+	m.counters[strings.Join(append([]string{name}, labels...), " ")]++
+}
+func (m *counterMetrics) SetGauge(name string, v float64, labels ...string)         {}
+func (m *counterMetrics) ObserveHistogram(name string, v float64, labels ...string) {}
+
+func TestShedAccounting(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	metrics := &counterMetrics{}
+	hbs.Metrics = metrics
+	var shed []string
+	hbs.OnShed = func(identifier string, reason ShedReason) {
+		shed = append(shed, identifier+" "+string(reason))
+	}
+	req := httptest.NewRequest("POST", "/", nil)
+	if !hbs.updateOrSaveSession("a", req, nil, 2) {
+		t.Fatal("expect the first beat recorded")
+	}
+	if hbs.updateOrSaveSession("a", req, nil, 1) {
+		t.Fatal("expect the overtaken beat shed")
+	}
+	hbs.Block("b")
+	if hbs.updateOrSaveSession("b", req, nil, 3) {
+		t.Fatal("expect the beat of a blocked identifier shed")
+	}
+	want := map[ShedReason]uint64{ShedOutOfOrder: 1, ShedBlocked: 1}
+	if got := hbs.Shed(); len(got) != len(want) || got[ShedOutOfOrder] != 1 || got[ShedBlocked] != 1 {
+		t.Fatalf("expect %v, got %v", want, got)
+	}
+	if strings.Join(shed, ", ") != "a out_of_order, b blocked" {
+		t.Fatalf("unexpected OnShed calls %v", shed)
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if metrics.counters[MetricShedBeats+" reason out_of_order"] != 1 || metrics.counters[MetricShedBeats+" reason blocked"] != 1 {
+		t.Fatalf("expect a shed counter per reason, got %v", metrics.counters)
+	}
+}
+
+func TestReportGaps(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.ProcessSynchronously = true
+	var gaps [][2]time.Time
+	hbs.OnClientGap = func(identifier string, from, to time.Time) {
+		gaps = append(gaps, [2]time.Time{from, to})
+	}
+	var down int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+		hbs.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL, ReportGaps: true}
+	beat := func(wantErr bool) {
+		if err := client.DoBeat(context.Background()); (err != nil) != wantErr {
+			t.Fatalf("expect error %v, got %v", wantErr, err)
+		}
+	}
+	beat(false)
+	beat(false)
+	before := time.Now()
+	atomic.StoreInt32(&down, 1)
+	beat(true) // the gap open at the first failed beat
+	beat(true)
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(10 * time.Millisecond)
+	beat(false) // handshake, the gap close
+	after := time.Now()
+	if len(gaps) != 0 {
+		t.Fatalf("gaps are only sent with timestamped beats, got %v", gaps)
+	}
+	beat(false)
+	beat(false)
+	if len(gaps) != 1 {
+		t.Fatalf("expect the gap reported once, got %v", gaps)
+	}
+	from, to := gaps[0][0], gaps[0][1]
+	if from.Before(before.Add(-time.Millisecond)) || to.After(after.Add(time.Millisecond)) || to.Sub(from) < 10*time.Millisecond {
+		t.Fatalf("unexpected gap %v - %v, outage %v - %v", from, to, before, after)
+	}
+}
+
+func TestDiagnoseSessions(t *testing.T) {
+	clock := newFakeClock()
+	hbs := NewServer("kitty", 4*time.Second)
+	hbs.Clock, hbs.NewTimer = clock.Now, clock.NewTimer
+	req := httptest.NewRequest("POST", "/", nil)
+	start := clock.Now()
+	hbs.updateOrSaveSession("b", req, nil, 0)
+	for i := 0; i < 3; i++ {
+		hbs.updateOrSaveSession("a", req, nil, 0)
+	}
+	clock.Advance(time.Second)
+	diags := hbs.DiagnoseSessions()
+	if len(diags) != 2 || diags[0].Identifier != "a" || diags[1].Identifier != "b" {
+		t.Fatalf("expect both sessions sorted, got %+v", diags)
+	}
+	a := diags[0]
+	if a.Beats != 3 || !a.LastBeat.Equal(start) || a.ArmedFor != 4*time.Second ||
+		!a.Deadline.Equal(start.Add(4*time.Second)) || a.Remaining != 3*time.Second || a.Frozen {
+		t.Fatalf("unexpected diagnostic %+v", a)
+	}
+	if a.Resets < 2 || a.Buffer < 1 {
+		t.Fatalf("expect the beats signalled to the timer, got %+v", a)
+	}
+
+	hbs.FreezeExpiry()
+	clock.Advance(time.Second)
+	if d := hbs.DiagnoseSessions()[0]; !d.Frozen || !d.Stopped || d.Remaining != 3*time.Second {
+		t.Fatalf("frozen session should keep its remaining time, got %+v", d)
+	}
+	hbs.UnfreezeExpiry()
+}
+
+func TestFreshnessFunc(t *testing.T) {
+	hbs := NewServer("kitty", time.Hour) // replays are remembered for the timeout, on the Clock
+	hbs.ProcessSynchronously = true
+	// a counter issued by the server instead of a wall clock time, advanced on every read
+	var counter int64 = 1000
+	hbs.Clock = func() time.Time { return time.Unix(atomic.AddInt64(&counter, 1), 0) }
+	var calls []string
+	hbs.FreshnessFunc = func(identifier, timestamp string, r *http.Request) error {
+		calls = append(calls, identifier+" "+timestamp)
+		n, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || n < atomic.LoadInt64(&counter)-100 {
+			return errors.New("challenge expired")
+		}
+		return nil
+	}
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL}
+	for i := 0; i < 3; i++ { // the counter is far from the real time, the built-in check would refuse it
+		if err := client.DoBeat(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.mu.Lock()
+	issued := client.timeKey
+	client.mu.Unlock()
+	if len(calls) != 2 || !strings.HasPrefix(calls[0], "whoami 10") {
+		t.Fatalf("expect one call per timestamped beat with the issued value, got %v", calls)
+	}
+
+	atomic.AddInt64(&counter, 1000) // the challenge of the client is old now
+	if err := client.DoBeat(context.Background()); err == nil || !strings.Contains(err.Error(), "Invalid timestamp, challenge expired") {
+		t.Fatalf("expect the error of FreshnessFunc, got %v", err)
+	}
+	if want := "whoami " + issued; calls[len(calls)-1] != want {
+		t.Fatalf("expect %q, got %v", want, calls)
+	}
+
+	calls = nil
+	req, _ := BuildBeatRequest(ts.URL, "whoami", "other", strconv.FormatInt(atomic.LoadInt64(&counter), 10), nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "messageMAC wrong") || len(calls) != 0 {
+		t.Fatalf("the MAC should be checked before FreshnessFunc, got %q and %v", body, calls)
+	}
+
+	hbs.ReplayProtection = true
+	timestamp := strconv.FormatInt(atomic.LoadInt64(&counter), 10)
+	for i, want := range []string{"", "messageMAC replayed"} {
+		req, _ := BuildBeatRequest(ts.URL, "whoami", "kitty", timestamp, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if (want == "") != (resp.StatusCode == http.StatusOK) || !strings.Contains(string(body), want) {
+			t.Fatalf("attempt %d: expect %q, got %d %q", i+1, want, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestStaleTimestampReport(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	var mu sync.Mutex
+	now := time.Now()
+	skew := 10 * time.Second // a server clock running away: every read is 10s later
+	hbs.Clock = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(skew)
+		return now
+	}
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	var reports []int
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL,
+		OnStaleTimestamp: func(count int) { reports = append(reports, count) }}
+	var stale int
+	for i := 0; i < 8; i++ { // handshakes succeed, the beats after them are stale
+		if err := client.DoBeat(context.Background()); IsStaleTimestamp(err) {
+			stale++
+		} else if err != nil {
+			t.Fatalf("expect only stale rejections, got %v", err)
+		}
+	}
+	if stale != 4 || client.StaleTimestamps() != 4 {
+		t.Fatalf("expect 4 stale rejections in a row, got %d and %d", stale, client.StaleTimestamps())
+	}
+	if len(reports) != 1 || reports[0] != defaultStaleThreshold {
+		t.Fatalf("expect one report at the threshold, got %v", reports)
+	}
+	if IsStaleTimestamp(errors.New("messageMAC wrong")) || IsStaleTimestamp(nil) {
+		t.Fatal("other failures are not stale")
+	}
+
+	mu.Lock()
+	skew = 0
+	mu.Unlock()
+	for i := 0; i < 2; i++ {
+		if err := client.DoBeat(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := client.StaleTimestamps(); n != 0 {
+		t.Fatalf("expect the count reset by an accepted beat, got %d", n)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestTLSSessionCache(t *testing.T) {
+	hbs := NewServer("kitty", 4*time.Second)
+	var mu sync.Mutex
+	var resumed []bool
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		resumed = append(resumed, r.TLS.DidResume)
+		mu.Unlock()
+		hbs.ServeHTTP(w, r)
+	}))
+	ts.StartTLS()
+	defer ts.Close()
+	base := ts.Client().Transport.(*http.Transport)
+	base.DisableKeepAlives = true // every beat on a new connection
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL,
+		Transport: base, TLSSessionCache: tls.NewLRUClientSessionCache(0)}
+	for i := 0; i < 3; i++ {
+		if err := client.DoBeat(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	if len(resumed) != 3 || resumed[0] || !resumed[1] || !resumed[2] {
+		t.Fatalf("expect the connections after the first resumed, got %v", resumed)
+	}
+	mu.Unlock()
+	if base.TLSClientConfig.ClientSessionCache != nil {
+		t.Fatal("the Transport of the client should not be modified")
+	}
+
+	other := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL, TLSSessionCache: tls.NewLRUClientSessionCache(0),
+		Transport: roundTripperFunc(base.RoundTrip)}
+	if err := other.DoBeat(context.Background()); err == nil || !strings.Contains(err.Error(), "tls session cache") {
+		t.Fatalf("expect a custom RoundTripper refused, got %v", err)
+	}
+}
+
+func TestSupersededRoaming(t *testing.T) {
+	hbs := NewServer("kitty", 200*time.Millisecond)
+	hbs.ProcessSynchronously = true
+	hbs.LastConnectionWins = true
+	hbs.FingerprintFunc = func(r *http.Request) string { return r.Header.Get("X-Network") } // stand for the client IP
+	ts := httptest.NewServer(hbs)
+	defer ts.Close()
+	var network atomic.Value
+	network.Store("wifi")
+	client := &Client{Secret: "kitty", Identifier: "whoami", ServerAddr: ts.URL, BeatInterval: 50 * time.Millisecond,
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			r.Header.Set("X-Network", network.Load().(string))
+			return http.DefaultTransport.RoundTrip(r)
+		})}
+	beat := func() error { return client.DoBeat(context.Background()) }
+	beat()
+	beat()
+	network.Store("cellular") // the device supersede its own session
+	if err := beat(); err != nil {
+		t.Fatal(err)
+	}
+	network.Store("wifi") // and is refused on its former address
+	err := beat()
+	if err == nil || !strings.Contains(err.Error(), "session superseded") {
+		t.Fatalf("expect 409, got %v", err)
+	}
+	if permanentError(err) != nil || client.NextBeatAfter() > 6*time.Second {
+		t.Fatalf("superseded should be retried, not backed off as permanent, next %v", client.NextBeatAfter())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.WaitConnected(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("WaitConnected should keep waiting, got %v", err)
+	}
+	time.Sleep(300 * time.Millisecond) // the session left on cellular time out
+	for i := 0; i < 2; i++ {
+		if err := beat(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !client.Connected() {
+		t.Fatal("expect the device connected again")
+	}
+}
+
+// BenchmarkExpirySweep measure the cost of expiring sessions, on the fake clock so no time is spent waiting:
+// b.N sessions with timeouts spread over 50ms ~ 249ms are created with the benchmark timer stopped,
+// their creation is reported as arm-ns/session. Then the clock jump past the longest timeout and the
+// benchmark wait until every session is disconnected, ns/op is that sweep: firing the timer, removing
+// the session and calling OnDisconnect, for one session. Run it with -benchtime=1000000x for scale numbers.
+func BenchmarkExpirySweep(b *testing.B) {
+	clock := newFakeClock()
+	hbs := NewServer("kitty", time.Second)
+	hbs.Clock, hbs.NewTimer = clock.Now, clock.NewTimer
+	hbs.TimeoutForIdentifier = sessionTimeouts
+	var wg sync.WaitGroup
+	wg.Add(b.N)
+	hbs.OnDisconnect = func(string) { wg.Done() }
+	req := httptest.NewRequest("POST", "/", nil)
+	b.ReportAllocs()
+	b.StopTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		hbs.updateOrSaveSession(fmt.Sprintf("s%d", i), req, nil, 0)
+	}
+	arm := time.Since(start)
+	b.StartTimer()
+	clock.Advance(time.Second)
+	wg.Wait()
+	b.StopTimer()
+	b.ReportMetric(float64(arm.Nanoseconds())/float64(b.N), "arm-ns/session")
+}
@@ -0,0 +1,128 @@
+package heartbeattest
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codeskyblue/heartbeat"
+	"github.com/pkg/errors"
+)
+
+// BeatFault is a way a beat fail verification, for testing rejection metrics and alerts
+type BeatFault int
+
+const (
+	// FaultWrongSecret sign the beat with another secret: 400 "messageMAC wrong"
+	FaultWrongSecret BeatFault = iota
+	// FaultTamperedIdentifier sign the beat for identifier, then send it for identifier+"-tampered":
+	// 400 "messageMAC wrong"
+	FaultTamperedIdentifier
+	// FaultExpiredTimestamp sign a beat a day old: 400 "Invalid timestamp, advanced or outdated",
+	// or the error of the FreshnessFunc of the server
+	FaultExpiredTimestamp
+	// FaultFutureTimestamp sign a beat a day ahead: the same rejection as FaultExpiredTimestamp
+	FaultFutureTimestamp
+	// FaultReplayed send a valid beat twice, the second is 400 "messageMAC replayed"
+	// when the server has ReplayProtection, else accepted.
+	// Both are probes (see heartbeat probe.go), so no session is created for identifier,
+	// the accepted ones are only counted by Server.Probes. Their messageMAC stay recorded as seen, though.
+	FaultReplayed
+)
+
+func (f BeatFault) String() string {
+	switch f {
+	case FaultWrongSecret:
+		return "wrong_secret"
+	case FaultTamperedIdentifier:
+		return "tampered_identifier"
+	case FaultExpiredTimestamp:
+		return "expired_timestamp"
+	case FaultFutureTimestamp:
+		return "future_timestamp"
+	case FaultReplayed:
+		return "replayed"
+	}
+	return "unknown"
+}
+
+// Rejection is the answer of the server to a faulty beat
+type Rejection struct {
+	Status int
+	Reason string // body of the reply, the error message when rejected
+}
+
+// SendFaultyBeat send to serverAddr a beat of identifier, structured like the ones of a Client with secret,
+// but failing verification as fault, and return how the server answered.
+// It runs against any server, heartbeattest or a real deployment in staging. The faults only
+// use the HMAC mode, and the clock of the caller for timestamps, so skew with the server is counted.
+func SendFaultyBeat(ctx context.Context, httpClient *http.Client, serverAddr, identifier, secret string, fault BeatFault) (Rejection, error) {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	now := time.Now()
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	var req *http.Request
+	var err error
+	switch fault {
+	case FaultWrongSecret:
+		req, err = heartbeat.BuildBeatRequest(serverAddr, identifier, secret+"-wrong", timestamp, nil)
+	case FaultTamperedIdentifier:
+		if req, err = heartbeat.BuildBeatRequest(serverAddr, identifier, secret, timestamp, nil); err == nil {
+			req, err = retarget(req, identifier+"-tampered")
+		}
+	case FaultExpiredTimestamp:
+		req, err = heartbeat.BuildBeatRequest(serverAddr, identifier, secret, strconv.FormatInt(now.Add(-24*time.Hour).Unix(), 10), nil)
+	case FaultFutureTimestamp:
+		req, err = heartbeat.BuildBeatRequest(serverAddr, identifier, secret, strconv.FormatInt(now.Add(24*time.Hour).Unix(), 10), nil)
+	case FaultReplayed:
+		probe := url.Values{"probe": {"1"}}
+		var first *http.Request
+		if first, err = heartbeat.BuildBeatRequest(serverAddr, identifier, secret, timestamp, probe); err != nil {
+			break
+		}
+		if _, err = send(ctx, httpClient, first); err != nil {
+			return Rejection{}, errors.Wrap(err, "first beat")
+		}
+		req, err = heartbeat.BuildBeatRequest(serverAddr, identifier, secret, timestamp, probe)
+	default:
+		return Rejection{}, errors.Errorf("unknown fault %d", fault)
+	}
+	if err != nil {
+		return Rejection{}, err
+	}
+	return send(ctx, httpClient, req)
+}
+
+// retarget replace the identifier of a signed beat, keeping its MAC
+func retarget(req *http.Request, identifier string) (*http.Request, error) {
+	if err := req.ParseForm(); err != nil {
+		return nil, errors.Wrap(err, "parse beat")
+	}
+	form := req.PostForm
+	form.Set("identifier", identifier)
+	payload := form.Encode()
+	tampered, err := http.NewRequest("POST", req.URL.String(), strings.NewReader(payload))
+	if err != nil {
+		return nil, errors.Wrap(err, "new request")
+	}
+	tampered.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return tampered, nil
+}
+
+func send(ctx context.Context, httpClient *http.Client, req *http.Request) (Rejection, error) {
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return Rejection{}, errors.Wrap(err, "post form")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Rejection{}, errors.Wrap(err, "ioutil readall")
+	}
+	return Rejection{Status: resp.StatusCode, Reason: strings.TrimSpace(string(body))}, nil
+}
@@ -0,0 +1,97 @@
+/*
+Package heartbeattest provide a heartbeat server for testing clients, with fault injection.
+
+Fault modes, all off by default and safe to change while serving:
+
+	Latency:   every request is delayed before being handled
+	ErrorRate: fraction of requests (0 ~ 1) answered with 500 instead of being handled
+	ClockSkew: offset added to the server clock, for timestamps checked and sent to clients
+
+Random faults come from a generator seeded by Seed, so a test run is reproducible.
+
+RunBeatRoundTrip check a Client and a Server agree on the protocol, in memory without network.
+SendFaultyBeat send beats failing verification in a chosen way (BeatFault), to check rejection
+metrics and alerts of a deployment.
+*/
+package heartbeattest
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/codeskyblue/heartbeat"
+)
+
+// Server is a heartbeat.Server listening on a local httptest server
+type Server struct {
+	*httptest.Server
+	Heartbeat *heartbeat.Server
+
+	mu        sync.Mutex
+	latency   time.Duration
+	errorRate float64
+	skew      time.Duration
+	rand      *rand.Rand
+}
+
+// NewServer start a test server, the caller should call Close when finished
+func NewServer(secret string, timeout time.Duration) *Server {
+	s := &Server{
+		Heartbeat: heartbeat.NewServer(secret, timeout),
+		rand:      rand.New(rand.NewSource(1)),
+	}
+	s.Heartbeat.Clock = func() time.Time {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return time.Now().Add(s.skew)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	latency := s.latency
+	fail := s.errorRate > 0 && s.rand.Float64() < s.errorRate
+	s.mu.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if fail {
+		http.Error(w, "injected failure", http.StatusInternalServerError)
+		return
+	}
+	s.Heartbeat.ServeHTTP(w, r)
+}
+
+// SetLatency delay every request by d
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// SetErrorRate answer a fraction p of requests with 500
+func (s *Server) SetErrorRate(p float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errorRate = p
+}
+
+// SetClockSkew shift the server clock by d
+func (s *Server) SetClockSkew(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skew = d
+}
+
+// Seed reset the random generator used for ErrorRate
+func (s *Server) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rand = rand.New(rand.NewSource(seed))
+}
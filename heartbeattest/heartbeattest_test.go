@@ -0,0 +1,117 @@
+package heartbeattest
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codeskyblue/heartbeat"
+)
+
+func TestRunBeatRoundTrip(t *testing.T) {
+	ts := NewServer("kitty", 4*time.Second)
+	defer ts.Close()
+	client := &heartbeat.Client{Secret: "kitty", Identifier: "whoami"}
+	result, err := RunBeatRoundTrip(client, ts.Heartbeat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.HandshakeStatus != http.StatusOK || result.BeatStatus != http.StatusOK {
+		t.Fatalf("expect both requests accepted, got %+v", result)
+	}
+	if result.Session.Identifier != "whoami" || result.Session.RemoteHost != "192.0.2.1" {
+		t.Fatalf("unexpected session %+v", result.Session)
+	}
+}
+
+func TestRunBeatRoundTripFailure(t *testing.T) {
+	ts := NewServer("kitty", 4*time.Second)
+	defer ts.Close()
+	client := &heartbeat.Client{Secret: "other", Identifier: "whoami"}
+	result, err := RunBeatRoundTrip(client, ts.Heartbeat)
+	if err == nil || !strings.Contains(err.Error(), "handshake") || !strings.Contains(err.Error(), "messageMAC wrong") {
+		t.Fatalf("expect the handshake refused, got %v", err)
+	}
+	if result.HandshakeStatus != http.StatusBadRequest {
+		t.Fatalf("expect 400 on handshake, got %+v", result)
+	}
+
+	ts.Heartbeat.RequireBuild = true
+	client = &heartbeat.Client{Secret: "kitty", Identifier: "whoami"}
+	result, err = RunBeatRoundTrip(client, ts.Heartbeat)
+	if err == nil || !strings.Contains(err.Error(), "build required") {
+		t.Fatalf("expect the handshake refused, got %v", err)
+	}
+	if result.HandshakeStatus != http.StatusBadRequest {
+		t.Fatalf("expect 400 on handshake, got %+v", result)
+	}
+	if _, ok := ts.Heartbeat.SessionInfo("whoami"); ok {
+		t.Fatal("refused beat should not create a session")
+	}
+}
+
+func TestFaultReplayed(t *testing.T) {
+	ts := NewServer("kitty", 4*time.Second)
+	defer ts.Close()
+	ts.Heartbeat.ReplayProtection = true
+	connects := 0
+	ts.Heartbeat.OnConnect = func(identifier string, r *http.Request) { connects++ }
+	rej, err := SendFaultyBeat(context.Background(), nil, ts.URL, "whoami", "kitty", FaultReplayed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rej.Status != http.StatusBadRequest || rej.Reason != "messageMAC replayed" {
+		t.Fatalf("unexpected rejection %+v", rej)
+	}
+	time.Sleep(10 * time.Millisecond) // sessions are saved in the background
+	if _, ok := ts.Heartbeat.SessionInfo("whoami"); ok || connects != 0 {
+		t.Fatal("replayed fault should not create a session")
+	}
+	if n := ts.Heartbeat.Probes(); n != 1 {
+		t.Fatalf("expect the first beat counted as probe, got %d", n)
+	}
+}
+
+func sendFault(t *testing.T, fault BeatFault) Rejection {
+	ts := NewServer("kitty", 4*time.Second)
+	defer ts.Close()
+	rej, err := SendFaultyBeat(context.Background(), nil, ts.URL, "whoami", "kitty", fault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rej
+}
+
+func TestFaultWrongSecret(t *testing.T) {
+	if rej := sendFault(t, FaultWrongSecret); rej.Status != http.StatusBadRequest || rej.Reason != "messageMAC wrong" {
+		t.Fatalf("unexpected rejection %+v", rej)
+	}
+}
+
+func TestFaultTamperedIdentifier(t *testing.T) {
+	if rej := sendFault(t, FaultTamperedIdentifier); rej.Status != http.StatusBadRequest || rej.Reason != "messageMAC wrong" {
+		t.Fatalf("unexpected rejection %+v", rej)
+	}
+}
+
+func TestFaultExpiredTimestamp(t *testing.T) {
+	rej := sendFault(t, FaultExpiredTimestamp)
+	if rej.Status != http.StatusBadRequest || rej.Reason != "Invalid timestamp, advanced or outdated" {
+		t.Fatalf("unexpected rejection %+v", rej)
+	}
+}
+
+func TestFaultFutureTimestamp(t *testing.T) {
+	rej := sendFault(t, FaultFutureTimestamp)
+	if rej.Status != http.StatusBadRequest || rej.Reason != "Invalid timestamp, advanced or outdated" {
+		t.Fatalf("unexpected rejection %+v", rej)
+	}
+}
+
+func TestFaultUnknown(t *testing.T) {
+	if _, err := SendFaultyBeat(context.Background(), nil, "http://heartbeat.test", "whoami", "kitty", BeatFault(-1)); err == nil {
+		t.Fatal("expect an error for an unknown fault")
+	}
+}
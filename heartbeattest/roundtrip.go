@@ -0,0 +1,89 @@
+package heartbeattest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/codeskyblue/heartbeat"
+	"github.com/pkg/errors"
+)
+
+// BeatResult is what RunBeatRoundTrip observed on both sides
+type BeatResult struct {
+	HandshakeStatus int // HTTP status of the timestamp fetch
+	BeatStatus      int // HTTP status of the signed beat
+	Session         heartbeat.SessionInfo
+	Elapsed         time.Duration
+}
+
+// RunBeatRoundTrip run the full exchange between client and server in memory, through the real handler:
+// fetch the server timestamp, send a signed beat, wait the session to exist on server.
+// Signatures are verified by both sides, any mismatch is returned as an error.
+//
+// It replaces client.Transport (and ServerAddr if empty), so pass a Client which did not beat yet.
+func RunBeatRoundTrip(client *heartbeat.Client, server *heartbeat.Server) (BeatResult, error) {
+	var result BeatResult
+	rt := &handlerTransport{handler: server}
+	client.Transport = rt
+	if client.ServerAddr == "" {
+		client.ServerAddr = "http://heartbeat.test"
+	}
+	start := time.Now()
+	ctx := context.Background()
+	err := client.DoBeat(ctx)
+	result.HandshakeStatus = rt.status()
+	if err != nil {
+		return result, errors.Wrap(err, "handshake")
+	}
+	err = client.DoBeat(ctx)
+	result.BeatStatus = rt.status()
+	if err != nil {
+		return result, errors.Wrap(err, "beat")
+	}
+	// the session is saved asynchronously after the reply
+	deadline := time.Now().Add(time.Second)
+	for {
+		info, ok := server.SessionInfo(client.Identifier)
+		if ok {
+			result.Session = info
+			break
+		}
+		if time.Now().After(deadline) {
+			return result, errors.New("session not created on server")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	result.Elapsed = time.Since(start)
+	return result, nil
+}
+
+// handlerTransport serve requests with handler directly, without network
+type handlerTransport struct {
+	handler http.Handler
+
+	mu   sync.Mutex
+	last int
+}
+
+func (t *handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	sreq := req.Clone(req.Context())
+	sreq.RemoteAddr = "192.0.2.1:1234"
+	sreq.RequestURI = req.URL.RequestURI()
+	rec := httptest.NewRecorder()
+	t.handler.ServeHTTP(rec, sreq)
+	resp := rec.Result()
+	resp.Request = req
+	t.mu.Lock()
+	t.last = resp.StatusCode
+	t.mu.Unlock()
+	return resp, nil
+}
+
+func (t *handlerTransport) status() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.last
+}
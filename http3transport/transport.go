@@ -0,0 +1,160 @@
+/*
+Package http3transport provide an HTTP/3 (QUIC) transport for heartbeat.Client.
+
+It is a separate module, so only users of it depend on quic-go.
+
+	client := &heartbeat.Client{
+		ServerAddr: "https://example.com/heartbeat",
+		Transport:  http3transport.New(),
+		...
+	}
+
+QUIC migrate connections across network changes (WiFi to cellular) and avoid head-of-line blocking,
+which make beats of mobile clients more reliable. The beat signing and loop are the same as over HTTP/1 and HTTP/2.
+
+When QUIC can not connect (UDP blocked, server without HTTP/3), the request is sent again through
+Fallback (HTTP/2 over TLS by default), and Fallback is used alone for FallbackFor before QUIC is tried again.
+Only failures of the dial or handshake are retried, before any byte of the request left: once the
+connection is up, the beat may have reached the server and the error is returned as is.
+
+Allow0RTT send beats as 0-RTT early data when resuming a QUIC session, saving a round trip
+on every new connection. quic-go only send GET in 0-RTT, so the beat form goes in the query string
+(the server read both). It is off by default: early data can be replayed by anyone on the path,
+before the handshake confirm the server. A replayed beat only refresh a session the client
+was keeping alive anyway, but enable Server.ReplayProtection so it is at least rejected once
+its messageMAC was seen. The server must accept 0-RTT too (quic.Config.Allow0RTT).
+*/
+package http3transport
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Transport send requests over HTTP/3, falling back to Fallback when QUIC is unavailable
+type Transport struct {
+	QUIC        *http3.Transport
+	Fallback    http.RoundTripper // default http.DefaultTransport
+	FallbackFor time.Duration     // default 1 minute
+
+	// Allow0RTT send beats as early data on resumed sessions, see the package doc for the replay risk.
+	// A TLS session cache is added to QUIC.TLSClientConfig if it has none.
+	Allow0RTT bool
+
+	mu       sync.Mutex
+	until    time.Time // use Fallback alone until
+	initOnce sync.Once
+}
+
+// New return a Transport with default settings
+func New() *Transport {
+	return &Transport{QUIC: &http3.Transport{}}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fallback := t.Fallback
+	if fallback == nil {
+		fallback = http.DefaultTransport
+	}
+	if req.URL.Scheme != "https" || t.fallingBack() {
+		return fallback.RoundTrip(req)
+	}
+	quicReq := req
+	if t.Allow0RTT {
+		t.initOnce.Do(t.initSessionCache)
+		if early, ok := earlyRequest(req); ok {
+			quicReq = early
+		}
+	}
+	var connected int32 // set once http3 got a connection, request bytes may be sent from then
+	trace := &httptrace.ClientTrace{GotConn: func(httptrace.GotConnInfo) { atomic.StoreInt32(&connected, 1) }}
+	quicReq = quicReq.WithContext(httptrace.WithClientTrace(quicReq.Context(), trace))
+	resp, err := t.QUIC.RoundTrip(quicReq)
+	if err == nil {
+		return resp, nil
+	}
+	if atomic.LoadInt32(&connected) != 0 || req.Context().Err() != nil {
+		return nil, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return nil, err // body consumed, can not send again
+	}
+	t.fallback()
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, berr := req.GetBody()
+		if berr != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+	return fallback.RoundTrip(retry)
+}
+
+func (t *Transport) initSessionCache() {
+	cfg := t.QUIC.TLSClientConfig
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	if cfg.ClientSessionCache == nil {
+		cfg = cfg.Clone()
+		cfg.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+		t.QUIC.TLSClientConfig = cfg
+	}
+}
+
+// earlyRequest turn a form POST into a GET allowed in 0-RTT, with the form in the query string
+func earlyRequest(req *http.Request) (*http.Request, bool) {
+	if req.Method != http.MethodPost || req.GetBody == nil ||
+		req.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+		return nil, false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, false
+	}
+	form, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, false
+	}
+	early := req.Clone(req.Context())
+	early.Method = http3.MethodGet0RTT
+	early.Body, early.GetBody, early.ContentLength = nil, nil, 0
+	early.Header.Del("Content-Type")
+	u := *req.URL
+	if u.RawQuery != "" {
+		u.RawQuery += "&"
+	}
+	u.RawQuery += string(form)
+	early.URL = &u
+	return early, true
+}
+
+func (t *Transport) fallingBack() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Now().Before(t.until)
+}
+
+func (t *Transport) fallback() {
+	d := t.FallbackFor
+	if d <= 0 {
+		d = time.Minute
+	}
+	t.mu.Lock()
+	t.until = time.Now().Add(d)
+	t.mu.Unlock()
+}
+
+// Close release the QUIC connections
+func (t *Transport) Close() error {
+	return t.QUIC.Close()
+}
@@ -0,0 +1,86 @@
+package http3transport
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// countingTransport count the requests sent through the fallback
+type countingTransport struct {
+	rt    http.RoundTripper
+	count int32
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.count, 1)
+	return t.rt.RoundTrip(req)
+}
+
+func newTransport(fallback http.RoundTripper) *Transport {
+	return &Transport{
+		QUIC: &http3.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			QUICConfig:      &quic.Config{HandshakeIdleTimeout: 200 * time.Millisecond},
+		},
+		Fallback: fallback,
+	}
+}
+
+func TestFallbackOnDialFailure(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("1234 mac"))
+	}))
+	defer ts.Close()
+	fallback := &countingTransport{rt: ts.Client().Transport}
+	tr := newTransport(fallback)
+	defer tr.Close()
+	// nothing listen on the UDP side of the TLS server
+	req, _ := http.NewRequest("POST", ts.URL, strings.NewReader("identifier=whoami"))
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || atomic.LoadInt32(&fallback.count) != 1 {
+		t.Fatalf("expect the request sent again through fallback, got %d %d", resp.StatusCode, fallback.count)
+	}
+}
+
+func TestNoFallbackAfterConnect(t *testing.T) {
+	cert := httptest.NewTLSServer(http.NotFoundHandler()) // only for its certificate
+	defer cert.Close()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("udp unavailable:", err)
+	}
+	var served int32
+	server := &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: cert.TLS.Certificates}),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&served, 1)
+			panic(http.ErrAbortHandler) // reset the stream, after the request was received
+		}),
+	}
+	go server.Serve(conn)
+	defer server.Close()
+
+	fallback := &countingTransport{rt: http.DefaultTransport}
+	tr := newTransport(fallback)
+	defer tr.Close()
+	req, _ := http.NewRequest("POST", "https://"+conn.LocalAddr().String(), strings.NewReader("identifier=whoami"))
+	if _, err := tr.RoundTrip(req); err == nil {
+		t.Fatal("expect the aborted request to fail")
+	}
+	if atomic.LoadInt32(&served) == 0 || atomic.LoadInt32(&fallback.count) != 0 {
+		t.Fatalf("request reaching the server should not be sent again, served %d, fallback %d", served, fallback.count)
+	}
+}
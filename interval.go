@@ -0,0 +1,32 @@
+package heartbeat
+
+import "time"
+
+// ConnectionInterval is one span an identifier was online, emitted when its session end.
+//
+// Start is when this session was started, also for a ReconnectResume (whose ConnectedAt is the
+// one of the previous session), so intervals of one identifier never overlap and the time between them
+// is downtime. End is when the session was disconnected, except for a timeout where it is the deadline
+// that expired: the client was not online while the timer was late to fire.
+// Sessions removed by Handover and Shutdown are not ended, no interval is emitted for them,
+// the interval continue on the server importing them, started at their ConnectedAt.
+type ConnectionInterval struct {
+	Identifier string
+	Start      time.Time
+	End        time.Time
+	Reason     DisconnectReason
+}
+
+// Duration is the time the identifier was online
+func (iv ConnectionInterval) Duration() time.Duration {
+	return iv.End.Sub(iv.Start)
+}
+
+// interval return the interval of sess, just disconnected, must hold s.mu
+func (s *Server) interval(sess *Session) ConnectionInterval {
+	end := s.now()
+	if sess.reason == ReasonTimeout && !s.frozen && sess.deadline.Before(end) && sess.deadline.After(sess.startedAt) {
+		end = sess.deadline
+	}
+	return ConnectionInterval{Identifier: sess.identifier, Start: sess.startedAt, End: end, Reason: sess.reason}
+}
@@ -0,0 +1,64 @@
+package heartbeat
+
+import "time"
+
+// lifetimeBounds are the upper bounds of session lifetime buckets
+var lifetimeBounds = []time.Duration{
+	time.Second,
+	5 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+	15 * time.Minute,
+	time.Hour,
+	6 * time.Hour,
+	24 * time.Hour,
+}
+
+// Histogram is a snapshot of durations counted into fixed buckets.
+// Counts[i] is the number of durations <= Bounds[i] (and above the previous bound),
+// the extra last element of Counts count durations over all bounds.
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+// histogram keep a fixed number of buckets, so memory does not grow with sessions
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(lifetimeBounds)+1)
+	}
+	i := 0
+	for i < len(lifetimeBounds) && d > lifetimeBounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += d
+}
+
+func (h *histogram) snapshot() Histogram {
+	counts := make([]uint64, len(lifetimeBounds)+1)
+	copy(counts, h.counts)
+	return Histogram{
+		Bounds: append([]time.Duration(nil), lifetimeBounds...),
+		Counts: counts,
+		Count:  h.count,
+		Sum:    h.sum,
+	}
+}
+
+// SessionLifetimes return the distribution of session durations, from connect to disconnect
+func (s *Server) SessionLifetimes() Histogram {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lifetimes.snapshot()
+}
@@ -0,0 +1,174 @@
+package heartbeat
+
+import (
+	"sort"
+	"time"
+	"unsafe"
+)
+
+/*
+Memory accounting ->
+
+Bytes are estimates, not measurements: every entry count a fixed overhead (the Go struct size,
+plus mapEntryOverhead for its map slot) and the length of the strings it hold, identifiers,
+keys, payloads and status documents. Every session also count sessionGoroutine bytes for the goroutine
+and timer running its timeout. Allocator slack and map growth are not counted, expect the real heap
+to be up to twice the Total.
+
+With MemoryBudget, the Total is checked at most every memoryCheckInterval when a session
+is created or a command queued, and structures are trimmed in this order until under budget:
+
+	Ended    reconnect windows (ReconnectPolicy), oldest first: the next beat is a plain connect
+	Credits  beat credit buckets, full ones first then all: clients restart with a full bucket
+	Sessions never evicted: while still over budget, new sessions are shed (ShedMemoryBudget)
+	         and SendCommand fail, online sessions keep working
+
+The replay cache (bounded by ReplayCacheSize) and the command queues (maxPendingCommands per identifier)
+are counted but never trimmed by the budget.
+*/
+
+const (
+	mapEntryOverhead    = 48
+	sessionGoroutine    = 4096
+	memoryCheckInterval = 5 * time.Second
+)
+
+// MemoryStat is the approximate footprint of one internal structure
+type MemoryStat struct {
+	Entries int
+	Bytes   int64
+}
+
+// MemoryStats is the approximate footprint of the server state, see memory.go for the method
+type MemoryStats struct {
+	Sessions    MemoryStat
+	ReplayCache MemoryStat
+	Ended       MemoryStat // last sessions remembered for ReconnectPolicy
+	Credits     MemoryStat
+	Commands    MemoryStat
+	Blocked     MemoryStat
+	Watchers    MemoryStat
+	Conns       MemoryStat // connections tracked by DisconnectOnClose
+	Total       int64
+	OverBudget  bool // new sessions are shed until the Total is under MemoryBudget
+}
+
+// MemoryStats return the approximate memory used by each internal structure
+func (s *Server) MemoryStats() MemoryStats {
+	st := MemoryStats{ReplayCache: s.replayMemory()}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.memoryStats(&st)
+	st.OverBudget = s.overBudget
+	return st
+}
+
+func (s *Server) replayMemory() MemoryStat {
+	if !s.ReplayProtection {
+		return MemoryStat{}
+	}
+	n := s.replayCache().stats().Size
+	// keys are hex sha256, 64 bytes, with a time.Time deadline
+	return MemoryStat{Entries: n, Bytes: int64(n) * (64 + int64(unsafe.Sizeof(time.Time{})) + mapEntryOverhead)}
+}
+
+// memoryStats fill the structures guarded by s.mu and the Total, must hold s.mu
+func (s *Server) memoryStats(st *MemoryStats) {
+	sessionSize := int64(unsafe.Sizeof(Session{})) + mapEntryOverhead + sessionGoroutine
+	for id, sess := range s.sessions {
+		st.Sessions.Bytes += sessionSize + int64(2*len(id)+len(sess.remoteHost)+len(sess.status)+len(sess.fingerprint)+len(sess.build)+len(sess.will)+8*cap(sess.recvC))
+		for _, fp := range sess.superseded {
+			st.Sessions.Bytes += int64(len(fp)) + 16
+		}
+	}
+	st.Sessions.Entries = len(s.sessions)
+
+	st.Ended.Entries = len(s.ended)
+	for id := range s.ended {
+		st.Ended.Bytes += int64(unsafe.Sizeof(ended{})) + mapEntryOverhead + int64(len(id))
+	}
+	st.Credits.Entries = len(s.credits)
+	for id := range s.credits {
+		st.Credits.Bytes += int64(unsafe.Sizeof(tokenBucket{})) + 8 + mapEntryOverhead + int64(len(id))
+	}
+	for id, cmds := range s.commands {
+		st.Commands.Entries += len(cmds)
+		st.Commands.Bytes += mapEntryOverhead + int64(len(id))
+		for _, cmd := range cmds {
+			st.Commands.Bytes += int64(unsafe.Sizeof(Command{}) + uintptr(len(cmd.ID)+len(cmd.Payload)))
+		}
+	}
+	st.Blocked.Entries = len(s.blocked)
+	for id := range s.blocked {
+		st.Blocked.Bytes += mapEntryOverhead + int64(len(id))
+	}
+	for id, fns := range s.watchers {
+		st.Watchers.Entries += len(fns)
+		st.Watchers.Bytes += mapEntryOverhead + int64(len(id)) + int64(len(fns))*8
+	}
+	st.Conns.Entries = len(s.conns)
+	for _, set := range s.conns {
+		st.Conns.Bytes += mapEntryOverhead + 16 + int64(len(set))*(mapEntryOverhead+8)
+	}
+	st.Total = st.Sessions.Bytes + st.ReplayCache.Bytes + st.Ended.Bytes + st.Credits.Bytes +
+		st.Commands.Bytes + st.Blocked.Bytes + st.Watchers.Bytes + st.Conns.Bytes
+}
+
+// checkBudget trim the caches when the state is over MemoryBudget, at most every memoryCheckInterval.
+// Return false while still over budget, must hold s.mu
+func (s *Server) checkBudget() bool {
+	if s.MemoryBudget <= 0 {
+		return true
+	}
+	now := time.Now()
+	if now.Sub(s.budgetChecked) < memoryCheckInterval {
+		return !s.overBudget
+	}
+	s.budgetChecked = now
+	st := MemoryStats{ReplayCache: s.replayMemory()}
+	s.memoryStats(&st)
+	over := st.Total - s.MemoryBudget
+	if over > 0 {
+		over -= s.trimEnded(over)
+	}
+	if over > 0 {
+		over -= s.trimCredits(over, now)
+	}
+	s.overBudget = over > 0
+	return !s.overBudget
+}
+
+// trimEnded drop the oldest reconnect windows, return the bytes freed, must hold s.mu
+func (s *Server) trimEnded(over int64) (freed int64) {
+	ids := make([]string, 0, len(s.ended))
+	for id := range s.ended {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return s.ended[ids[i]].at.Before(s.ended[ids[j]].at) })
+	for _, id := range ids {
+		if over <= freed {
+			break
+		}
+		delete(s.ended, id)
+		freed += int64(unsafe.Sizeof(ended{})) + mapEntryOverhead + int64(len(id))
+	}
+	return freed
+}
+
+// trimCredits drop the full credit buckets, then any, return the bytes freed, must hold s.mu
+func (s *Server) trimCredits(over int64, now time.Time) (freed int64) {
+	burst := s.creditBurst()
+	for _, fullOnly := range []bool{true, false} {
+		for id, b := range s.credits {
+			if over <= freed {
+				return freed
+			}
+			if fullOnly && b.peek(now, s.CreditRate, burst) < float64(burst) {
+				continue
+			}
+			delete(s.credits, id)
+			freed += int64(unsafe.Sizeof(tokenBucket{})) + 8 + mapEntryOverhead + int64(len(id))
+		}
+	}
+	return freed
+}
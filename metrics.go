@@ -0,0 +1,63 @@
+package heartbeat
+
+import "time"
+
+// Metrics receive the instrumentation of a Server, adapt it to Prometheus, OpenTelemetry or anything else.
+// labels are key value pairs, e.g. "code", "200", they never carry identifiers. Methods are called holding the server lock
+// for session lifecycle metrics, they must be fast and must not call Server methods.
+type Metrics interface {
+	IncCounter(name string, labels ...string)
+	SetGauge(name string, v float64, labels ...string)
+	ObserveHistogram(name string, v float64, labels ...string)
+}
+
+// metric names
+const (
+	MetricRequests          = "heartbeat_requests_total"           // counter, label code
+	MetricRequestSeconds    = "heartbeat_request_duration_seconds" // histogram
+	MetricConnects          = "heartbeat_connects_total"
+	MetricReconnects        = "heartbeat_reconnects_total"
+	MetricDisconnects       = "heartbeat_disconnects_total"
+	MetricBeats             = "heartbeat_beats_total"
+	MetricSessions          = "heartbeat_sessions" // gauge
+	MetricSessionLifetime   = "heartbeat_session_lifetime_seconds"
+	MetricCallbackSeconds   = "heartbeat_callback_duration_seconds" // histogram, label callback
+	MetricDroppedEvents     = "heartbeat_dropped_events_total"
+	MetricCadenceViolations = "heartbeat_cadence_violations_total"
+	MetricBusyWorkers       = "heartbeat_busy_workers"   // gauge
+	MetricAbsentClients     = "heartbeat_absent_clients" // gauge
+	MetricProbes            = "heartbeat_probes_total"
+	MetricShedBeats         = "heartbeat_shed_beats_total" // counter, label reason
+)
+
+type noopMetrics struct{}
+
+func (noopMetrics) IncCounter(name string, labels ...string)                  {}
+func (noopMetrics) SetGauge(name string, v float64, labels ...string)         {}
+func (noopMetrics) ObserveHistogram(name string, v float64, labels ...string) {}
+
+func (s *Server) metrics() Metrics {
+	if s.Metrics == nil {
+		return noopMetrics{}
+	}
+	return s.Metrics
+}
+
+// anonymize apply AnonymizeFunc, for every identifier leaving through logs or labels
+func (s *Server) anonymize(identifier string) string {
+	if s.AnonymizeFunc == nil || identifier == "" {
+		return identifier
+	}
+	return s.AnonymizeFunc(identifier)
+}
+
+// callback run a user callback, observing how long it take
+func (s *Server) callback(name string, fn func()) {
+	if s.Metrics == nil {
+		fn()
+		return
+	}
+	start := time.Now()
+	fn()
+	s.Metrics.ObserveHistogram(MetricCallbackSeconds, time.Since(start).Seconds(), "callback", name)
+}
@@ -0,0 +1,189 @@
+package heartbeat
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+Drain and migrate, to replace a node without downtime ->
+
+ 1. DrainAndMigrate(ctx, target): every online session get the command "migrate {target}" (signed like
+    every command). Handshakes of identifiers without the command are redirected to target (reply extra
+    redirect), ReadyHandler answer 503 so the orchestrator stop routing new clients to the node.
+    Beats are still accepted, sessions keep working until they leave.
+ 2. A Client receiving the command say goodbye on its next beat, acknowledging the command,
+    then handshake with target. OnConnect is not called again on the client, the server target
+    call its own OnConnect.
+ 3. DrainAndMigrate return when every session of step 1 is gone, or ctx is done.
+    The report tell the identifiers which acknowledged the command (Migrated) and the others
+    (TimedOut): still online at the deadline, or ended without acknowledging, e.g. by timeout.
+    When ctx is done the migration is cancelled, as by CancelMigration: the node is back in service,
+    the clients still online stay, and DrainAndMigrate can be called again.
+
+Sessions started during the migration, by clients holding a timestamp, are not waited for, their replies
+carry the redirect. Call Shutdown or Handover once DrainAndMigrate returned without error,
+or CancelMigration to keep the node in service.
+*/
+
+const migratePrefix = "migrate "
+
+// MigrationReport is the outcome of DrainAndMigrate
+type MigrationReport struct {
+	Target   string
+	Migrated []string
+	TimedOut []string
+	Elapsed  time.Duration
+}
+
+type migration struct {
+	target   string
+	commands map[string]string // identifier -> id of its migrate command
+	acked    map[string]bool
+}
+
+// DrainAndMigrate move the clients of the server to target, see migrate.go for the flow.
+// When ctx is done before every client left, the report is returned with ctx.Err().
+func (s *Server) DrainAndMigrate(ctx context.Context, target string) (MigrationReport, error) {
+	report := MigrationReport{Target: target}
+	if target == "" {
+		return report, errors.New("empty migration target")
+	}
+	start := time.Now()
+	s.mu.Lock()
+	if s.migration != nil {
+		s.mu.Unlock()
+		return report, errors.New("migration already started")
+	}
+	m := &migration{target: target, commands: make(map[string]string), acked: make(map[string]bool)}
+	quit := make(map[string]chan struct{}, len(s.sessions))
+	for identifier, sess := range s.sessions {
+		quit[identifier] = sess.quitC
+		// a full queue leave the session without command, it is reported TimedOut unless it leave otherwise
+		if id, err := s.queueCommand(identifier, migratePrefix+target); err == nil {
+			m.commands[identifier] = id
+		}
+	}
+	s.migration = m
+	s.mu.Unlock()
+
+	var err error
+	for _, q := range quit {
+		select {
+		case <-q:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	s.mu.Lock()
+	if err != nil {
+		s.endMigration(m)
+	}
+	for identifier := range quit {
+		if m.acked[identifier] {
+			report.Migrated = append(report.Migrated, identifier)
+		} else {
+			report.TimedOut = append(report.TimedOut, identifier)
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(report.Migrated)
+	sort.Strings(report.TimedOut)
+	report.Elapsed = time.Since(start)
+	return report, err
+}
+
+// CancelMigration end the migration of DrainAndMigrate: handshakes are not redirected anymore,
+// ReadyHandler report ready again, and the migrate commands not delivered yet are withdrawn.
+// Clients which already received their command still migrate. A DrainAndMigrate still waiting is not interrupted.
+func (s *Server) CancelMigration() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.endMigration(s.migration)
+}
+
+// endMigration clear migration m if it is still the current one, must hold s.mu
+func (s *Server) endMigration(m *migration) {
+	if m == nil || s.migration != m {
+		return
+	}
+	for identifier, id := range m.commands {
+		if !m.acked[identifier] {
+			s.dropCommands(identifier, map[string]bool{id: true})
+		}
+	}
+	s.migration = nil
+}
+
+func (s *Server) isMigrating() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.migration != nil
+}
+
+// migrateExtra redirect identifier to the migration target unless its migrate command is pending, must hold s.mu
+func (s *Server) migrateExtra(identifier string, extra url.Values) {
+	if s.migration == nil {
+		return
+	}
+	if _, ok := s.migration.commands[identifier]; !ok || s.migration.acked[identifier] {
+		extra.Set(extraRedirect, s.migration.target)
+	}
+}
+
+// noteMigrateAck remember identifier acknowledged its migrate command, must hold s.mu
+func (s *Server) noteMigrateAck(identifier string, acked map[string]bool) {
+	if s.migration == nil {
+		return
+	}
+	if id, ok := s.migration.commands[identifier]; ok && acked[id] {
+		s.migration.acked[identifier] = true
+	}
+}
+
+// receiveMigrate take a migrate command out of the inbox flow, must hold c.mu
+func (c *Client) receiveMigrate(cmd Command) bool {
+	if !strings.HasPrefix(cmd.Payload, migratePrefix) {
+		return false
+	}
+	if target := strings.TrimPrefix(cmd.Payload, migratePrefix); target != "" && c.migrateID != cmd.ID {
+		c.migrateID, c.migrateTo = cmd.ID, target
+	}
+	return true
+}
+
+// migrate say goodbye to the current endpoint, acknowledging the migrate command, and switch to its target.
+// The goodbye is best effort, the old session time out if it is lost.
+func (c *Client) migrate(ctx context.Context) {
+	c.mu.Lock()
+	target, timeKey := c.migrateTo, c.timeKey
+	if target == "" {
+		c.mu.Unlock()
+		return
+	}
+	if c.acked == nil {
+		c.acked = make(map[string]bool)
+	}
+	c.acked[c.migrateID] = true
+	c.bye = timeKey != ""
+	c.mu.Unlock()
+	if timeKey != "" {
+		c.httpBeat(ctx, timeKey, c.Endpoint())
+	}
+	c.mu.Lock()
+	c.bye = false
+	c.timeKey = ""
+	c.redirect = target
+	c.migrateTo = ""
+	c.migrated = true
+	c.mu.Unlock()
+}
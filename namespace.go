@@ -0,0 +1,76 @@
+package heartbeat
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Namespaces serve several independent heartbeat servers on one handler.
+// The namespace is the first path segment of the request, clients put it in ServerAddr:
+//
+//	ns := heartbeat.NewNamespaces()
+//	ns.Handle("chat", heartbeat.NewServer("secret1", 10*time.Second))
+//	ns.Handle("jobs", heartbeat.NewServer("secret2", time.Minute))
+//	http.Handle("/heartbeat/", http.StripPrefix("/heartbeat", ns))
+//	// client: ServerAddr: "http://host/heartbeat/chat"
+//
+// Every namespace is a plain Server: its own secret, timeout, callbacks and sessions.
+// The same identifier in two namespaces is two sessions, and a client of one namespace
+// can not beat into another without its secret. Unknown namespaces get 404.
+type Namespaces struct {
+	mu      sync.RWMutex
+	servers map[string]*Server
+}
+
+// NewNamespaces return an empty namespace router
+func NewNamespaces() *Namespaces {
+	return &Namespaces{servers: make(map[string]*Server)}
+}
+
+// Handle serve s under namespace name, replacing the previous server of name
+func (n *Namespaces) Handle(name string, s *Server) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.servers[name] = s
+}
+
+// Remove stop routing to namespace name and return its server, nil if unknown.
+// Its sessions stay online until they time out, call Shutdown on it to drop them.
+func (n *Namespaces) Remove(name string) *Server {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	s := n.servers[name]
+	delete(n.servers, name)
+	return s
+}
+
+// Server return the server of namespace name, nil if unknown
+func (n *Namespaces) Server(name string) *Server {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.servers[name]
+}
+
+// Names return the sorted namespaces
+func (n *Namespaces) Names() []string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	names := make([]string, 0, len(n.servers))
+	for name := range n.servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (n *Namespaces) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+	s := n.Server(name)
+	if s == nil {
+		http.Error(w, "unknown namespace", http.StatusNotFound)
+		return
+	}
+	s.ServeHTTP(w, r)
+}
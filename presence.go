@@ -0,0 +1,28 @@
+package heartbeat
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+)
+
+// PresenceDigest return a summary of the online identifiers, so an external copy of
+// presence can be checked cheaply and pulled in full only when the digest differ.
+//
+// hash is the hex SHA-256 of the sorted identifiers, each followed by "\n".
+// It depends only on the set of identifiers, so it is stable across calls, restarts and servers.
+func (s *Server) PresenceDigest() (hash string, count int) {
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.sessions))
+	for id := range s.sessions {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+	sort.Strings(ids)
+	h := sha256.New()
+	for _, id := range ids {
+		h.Write([]byte(id))
+		h.Write([]byte("\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil)), len(ids)
+}
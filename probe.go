@@ -0,0 +1,37 @@
+package heartbeat
+
+import (
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Probe ->
+
+	Request extra: probe=1, signed with the extraMAC like every request extra,
+	so a probe can not be forged into, or out of, a real beat without the secret.
+
+The server check messageMAC, extraMAC, the timestamp and replay exactly like a beat, and refuse
+blocked, throttled and out of credit identifiers like a beat, then answer a bare signed timestamp.
+No session, callback, event, group quota or presence metric is touched, probes are only counted
+by Probes and MetricProbes.
+*/
+
+const fieldProbe = "probe"
+
+// serveProbe verify a probe and reply without touching sessions
+func (s *Server) serveProbe(w http.ResponseWriter, r *http.Request, identifier, timestamp, messageMAC string, sg replySigner, timeout time.Duration) {
+	if timestamp != "" && !s.checkTimestamp(w, r, identifier, timestamp, messageMAC, timeout) {
+		return
+	}
+	atomic.AddUint64(&s.probes, 1)
+	s.metrics().IncCounter(MetricProbes)
+	s.sendReply(w, s.timestamp(), sg, url.Values{})
+}
+
+// Probes return the number of verified probe requests
+func (s *Server) Probes() uint64 {
+	return atomic.LoadUint64(&s.probes)
+}
@@ -0,0 +1,154 @@
+package heartbeat
+
+import (
+	"net/http"
+	"time"
+)
+
+// GroupQuota limit one group of identifiers, zero fields mean unlimited
+type GroupQuota struct {
+	MaxSessions int     // concurrent sessions, new sessions over it get 503
+	Rate        float64 // beats per second of the whole group, beats over it get 429
+	Burst       int     // beats allowed at once over Rate, default 1
+}
+
+type groupState struct {
+	sessions int
+	bucket   tokenBucket
+}
+
+// tokenBucket refill rate tokens per second up to burst
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// peek return the tokens at now without taking one
+func (b *tokenBucket) peek(now time.Time, rate float64, burst int) float64 {
+	if burst < 1 {
+		burst = 1
+	}
+	if b.last.IsZero() {
+		return float64(burst)
+	}
+	tokens := b.tokens + now.Sub(b.last).Seconds()*rate
+	if tokens > float64(burst) {
+		tokens = float64(burst)
+	}
+	return tokens
+}
+
+// take one token, return false if there is none
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) bool {
+	if burst < 1 {
+		burst = 1
+	}
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (s *Server) groupOf(identifier string) string {
+	if s.GroupFunc == nil {
+		return ""
+	}
+	return s.GroupFunc(identifier)
+}
+
+func (s *Server) groupQuota(group string) GroupQuota {
+	if q, ok := s.GroupQuotas[group]; ok {
+		return q
+	}
+	return s.DefaultGroupQuota
+}
+
+// group return the state of group, must hold s.mu
+func (s *Server) group(group string) *groupState {
+	if s.groups == nil {
+		s.groups = make(map[string]*groupState)
+	}
+	g, ok := s.groups[group]
+	if !ok {
+		g = &groupState{}
+		s.groups[group] = g
+	}
+	return g
+}
+
+// admit check the blocklist and group quotas of a verified identifier, handshakes included:
+// a full group refuse the handshake of a new client, not only its first beat.
+// Rejected requests get an error reply.
+func (s *Server) admit(w http.ResponseWriter, identifier string) bool {
+	group := s.groupOf(identifier)
+	q := s.groupQuota(group)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	t, priority, ok := s.admitIdentifier(w, identifier, now)
+	if !ok {
+		return false
+	}
+	priority = priority && t == nil
+	if q.Rate > 0 && !s.group(group).bucket.take(now, q.Rate, q.Burst) && !priority {
+		http.Error(w, "group rate exceeded", http.StatusTooManyRequests)
+		return false
+	}
+	if _, online := s.sessions[identifier]; !online && q.MaxSessions > 0 && s.group(group).sessions >= q.MaxSessions {
+		// a session may free up once one time out
+		writeRetryAfter(w, "group session quota exceeded", http.StatusServiceUnavailable, s.timeoutFor(identifier))
+		return false
+	}
+	return true
+}
+
+// admitProbe check the blocklist, throttle and beat credits of a probe, must not hold s.mu.
+// Probes leave the group quotas alone, they start no session.
+func (s *Server) admitProbe(w http.ResponseWriter, identifier string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, _, ok := s.admitIdentifier(w, identifier, s.now())
+	return ok
+}
+
+// admitIdentifier check the blocklist, throttle and beat credits of identifier, must hold s.mu.
+// t is its active throttle, priority tell the credit policy let it pass the group rate.
+func (s *Server) admitIdentifier(w http.ResponseWriter, identifier string, now time.Time) (t *throttle, priority bool, ok bool) {
+	if s.blocked[identifier] {
+		http.Error(w, "identifier blocked", http.StatusForbidden)
+		return nil, false, false
+	}
+	t = s.throttled(identifier, now)
+	if !s.admitThrottled(w, t, now) {
+		return nil, false, false
+	}
+	credit, priority := s.spendCredit(identifier, now)
+	if !credit {
+		http.Error(w, "beat credit exhausted", http.StatusTooManyRequests)
+		return nil, false, false
+	}
+	return t, priority, true
+}
+
+// GroupCounts return the number of online sessions of each group
+func (s *Server) GroupCounts() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[string]int, len(s.groups))
+	for name, g := range s.groups {
+		if g.sessions > 0 {
+			counts[name] = g.sessions
+		}
+	}
+	return counts
+}
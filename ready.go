@@ -0,0 +1,73 @@
+package heartbeat
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+const defaultReadyCacheTTL = time.Second
+
+// readiness cache the last result of ReadyFunc
+type readiness struct {
+	err     error
+	checked time.Time
+	pinging bool
+	done    chan struct{} // closed when the running ping finish
+}
+
+// ready return the cached result of ReadyFunc, pinging again when it is older than ReadyCacheTTL.
+// While a ping run, other callers get the previous result, only the very first check is waited for.
+func (s *Server) ready() error {
+	if s.ReadyFunc == nil {
+		return nil
+	}
+	ttl := s.ReadyCacheTTL
+	if ttl <= 0 {
+		ttl = defaultReadyCacheTTL
+	}
+	s.readyMu.Lock()
+	r := &s.readiness
+	if !r.checked.IsZero() && (r.pinging || time.Since(r.checked) < ttl) {
+		err := r.err
+		s.readyMu.Unlock()
+		return err
+	}
+	if r.pinging { // first check still running
+		done := r.done
+		s.readyMu.Unlock()
+		<-done
+		s.readyMu.Lock()
+		defer s.readyMu.Unlock()
+		return r.err
+	}
+	r.pinging = true
+	r.done = make(chan struct{})
+	s.readyMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), ttl)
+	err := s.ReadyFunc(ctx)
+	cancel()
+
+	s.readyMu.Lock()
+	defer s.readyMu.Unlock()
+	r.err, r.checked, r.pinging = err, time.Now(), false
+	close(r.done)
+	return err
+}
+
+// ReadyHandler answer 200 when the server can maintain presence, 503 while ReadyFunc fail
+// or the server is draining, migrating or shut down. Mount it for the readiness probe of the orchestrator.
+func (s *Server) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.isDraining() || s.isMigrating() {
+			http.Error(w, "server draining", http.StatusServiceUnavailable)
+			return
+		}
+		if err := s.ready(); err != nil {
+			http.Error(w, "not ready: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+}
@@ -0,0 +1,125 @@
+package heartbeat
+
+import "time"
+
+/*
+ReconnectPolicy decide what a beat of an identifier without session is, when its previous
+session ended within the Window of the rule for how it ended:
+
+	previous session ended by      rule          default
+	timeout                        AfterTimeout  {0, ReconnectNew}
+	Client.Bye                     AfterBye      {ByeWindow or 5s, ReconnectIgnore}
+	Block, connection close        AfterForced   {0, ReconnectNew}
+	superseded                     none, the new device always connect
+
+	action           session                         callback       event
+	ReconnectNew     new, ConnectedAt now            OnConnect      EventConnect
+	ReconnectResume  new, ConnectedAt of the old one OnReconnect    EventReconnect
+	ReconnectIgnore  none, the beat is shed          none           none
+
+Past the Window, or when the identifier never had a session, the beat is a ReconnectNew.
+A beat of an online session is always a continuation. Only the last ended session of an
+identifier is remembered, for the longest Window, at most maxEndedEntries identifiers.
+*/
+
+// ReconnectAction is what to do with a beat coming back soon after its session ended
+type ReconnectAction int
+
+const (
+	ReconnectNew ReconnectAction = iota
+	ReconnectResume
+	ReconnectIgnore
+)
+
+// ReconnectRule apply Action to beats coming back within Window after the session ended
+type ReconnectRule struct {
+	Window time.Duration
+	Action ReconnectAction
+}
+
+// ReconnectPolicy hold one rule per way a session can end, see the decision table above
+type ReconnectPolicy struct {
+	AfterTimeout ReconnectRule
+	AfterBye     ReconnectRule
+	AfterForced  ReconnectRule
+}
+
+const maxEndedEntries = 16384
+
+// ended is the last session of an identifier
+type ended struct {
+	reason      DisconnectReason
+	at          time.Time
+	connectedAt time.Time
+}
+
+func (s *Server) reconnectPolicy() ReconnectPolicy {
+	if s.ReconnectPolicy != nil {
+		return *s.ReconnectPolicy
+	}
+	window := s.ByeWindow
+	if window <= 0 {
+		window = defaultByeWindow
+	}
+	return ReconnectPolicy{AfterBye: ReconnectRule{Window: window, Action: ReconnectIgnore}}
+}
+
+func (p ReconnectPolicy) rule(reason DisconnectReason) ReconnectRule {
+	switch reason {
+	case ReasonTimeout:
+		return p.AfterTimeout
+	case ReasonBye:
+		return p.AfterBye
+	}
+	return p.AfterForced
+}
+
+func (p ReconnectPolicy) maxWindow() time.Duration {
+	max := p.AfterTimeout.Window
+	if p.AfterBye.Window > max {
+		max = p.AfterBye.Window
+	}
+	if p.AfterForced.Window > max {
+		max = p.AfterForced.Window
+	}
+	return max
+}
+
+// noteEnded remember how the session of identifier ended, must hold s.mu
+func (s *Server) noteEnded(identifier string, reason DisconnectReason, connectedAt time.Time) {
+	p := s.reconnectPolicy()
+	if p.rule(reason).Window <= 0 {
+		delete(s.ended, identifier)
+		return
+	}
+	now := s.now()
+	if s.ended == nil {
+		s.ended = make(map[string]ended)
+	}
+	if _, ok := s.ended[identifier]; !ok && len(s.ended) >= maxEndedEntries {
+		max := p.maxWindow()
+		for id, e := range s.ended {
+			if now.Sub(e.at) >= max {
+				delete(s.ended, id)
+			}
+		}
+		if len(s.ended) >= maxEndedEntries {
+			return // full of sessions ended recently, treat this one as never seen
+		}
+	}
+	s.ended[identifier] = ended{reason: reason, at: now, connectedAt: connectedAt}
+}
+
+// reconnectAction return the action for a beat of identifier without session, must hold s.mu
+func (s *Server) reconnectAction(identifier string) (ReconnectAction, ended) {
+	e, ok := s.ended[identifier]
+	if !ok {
+		return ReconnectNew, ended{}
+	}
+	rule := s.reconnectPolicy().rule(e.reason)
+	if s.now().Sub(e.at) >= rule.Window {
+		delete(s.ended, identifier)
+		return ReconnectNew, ended{}
+	}
+	return rule.Action, e
+}
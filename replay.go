@@ -0,0 +1,167 @@
+package heartbeat
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	cacheShards          = 16
+	defaultReplayEntries = 65536
+)
+
+// CacheStats is a read-only snapshot of a cache
+type CacheStats struct {
+	Size      int    // entries currently stored
+	Capacity  int    // max entries, across all shards
+	Hits      uint64 // lookups found an unexpired entry (replays for the replay cache)
+	Misses    uint64 // lookups found nothing, the key got stored
+	Evictions uint64 // unexpired entries dropped to make room
+}
+
+// ttlCache is a sharded set of keys, each key expires after its own deadline.
+//
+// Each shard hold at most capacity/cacheShards entries. When a shard is full,
+// expired entries are purged first, then the entry closest to its deadline is evicted.
+type ttlCache struct {
+	shards    [cacheShards]cacheShard
+	perShard  int
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type cacheShard struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+func newTTLCache(capacity int) *ttlCache {
+	perShard := capacity / cacheShards
+	if perShard < 1 {
+		perShard = 1
+	}
+	c := &ttlCache{perShard: perShard}
+	for i := range c.shards {
+		c.shards[i].entries = make(map[string]time.Time)
+	}
+	return c
+}
+
+func (c *ttlCache) shard(key string) *cacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &c.shards[h.Sum32()%cacheShards]
+}
+
+// add store key until deadline, return false if key is already there and not expired
+func (c *ttlCache) add(key string, now, deadline time.Time) bool {
+	sh := c.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if exp, ok := sh.entries[key]; ok && now.Before(exp) {
+		atomic.AddUint64(&c.hits, 1)
+		return false
+	}
+	atomic.AddUint64(&c.misses, 1)
+	if len(sh.entries) >= c.perShard {
+		for k, exp := range sh.entries {
+			if !now.Before(exp) {
+				delete(sh.entries, k)
+			}
+		}
+	}
+	if len(sh.entries) >= c.perShard {
+		var oldest string
+		var oldestExp time.Time
+		for k, exp := range sh.entries {
+			if oldest == "" || exp.Before(oldestExp) {
+				oldest, oldestExp = k, exp
+			}
+		}
+		delete(sh.entries, oldest)
+		atomic.AddUint64(&c.evictions, 1)
+	}
+	sh.entries[key] = deadline
+	return true
+}
+
+// has report whether key is stored and not expired, without counting a hit or miss
+func (c *ttlCache) has(key string, now time.Time) bool {
+	sh := c.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	exp, ok := sh.entries[key]
+	return ok && now.Before(exp)
+}
+
+func (c *ttlCache) clear() {
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		sh.entries = make(map[string]time.Time)
+		sh.mu.Unlock()
+	}
+}
+
+func (c *ttlCache) stats() CacheStats {
+	st := CacheStats{
+		Capacity:  c.perShard * cacheShards,
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+	}
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		st.Size += len(sh.entries)
+		sh.mu.Unlock()
+	}
+	return st
+}
+
+// timestamp return the server timestamp of a reply, the unix seconds of now.
+// With ReplayProtection it carry a fractional part too, in nanoseconds, never issued twice by s:
+// a client echo it in the messageMAC of its next beat, so a beat following a handshake or another
+// beat within the same second is not taken for a replay. Only the seconds are checked against the timeout.
+func (s *Server) timestamp() string {
+	now := s.now()
+	if !s.ReplayProtection {
+		return strconv.FormatInt(now.Unix(), 10)
+	}
+	for {
+		last := atomic.LoadInt64(&s.lastTimestamp)
+		t := now.UnixNano()
+		if t <= last {
+			t = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&s.lastTimestamp, last, t) {
+			return fmt.Sprintf("%d.%09d", t/int64(time.Second), t%int64(time.Second))
+		}
+	}
+}
+
+func (s *Server) replayCache() *ttlCache {
+	s.replayOnce.Do(func() {
+		size := s.ReplayCacheSize
+		if size <= 0 {
+			size = defaultReplayEntries
+		}
+		s.replay = newTTLCache(size)
+	})
+	return s.replay
+}
+
+// ReplayCacheStats return size, hit and eviction counters of the replay cache
+func (s *Server) ReplayCacheStats() CacheStats {
+	return s.replayCache().stats()
+}
+
+// ClearReplayCache forget all seen messageMAC, e.g. after a clock adjustment
+func (s *Server) ClearReplayCache() {
+	s.replayCache().clear()
+}
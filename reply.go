@@ -0,0 +1,151 @@
+package heartbeat
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+/*
+Server reply ->
+
+	Line 1: {timestamp} {hashmac}
+	Line 2: {extra} {extramac} (optional)
+
+extra is url encoded key values (sorted by key), extramac is the HMAC of "{timestamp}:{extra}:extra",
+so a directive can not be moved to another reply. Old clients only read the first line.
+
+Rewriting intermediaries ->
+
+Server.ReplyTransform get the signed reply above and return the body actually written,
+Client.ReplyExtract get the body received and return the signed reply. The contract: the signed
+reply must come out of ReplyExtract byte for byte, whatever the intermediary added around it.
+Bytes appended after the signed reply on new lines are already ignored without any hook, with or
+without an extra line: line 2 is only taken as the extra when it is two fields ending with a hex MAC.
+FrameReply and UnframeReply are a ready pair for prefixes and rewrites around the reply.
+*/
+
+// directive keys in reply extra
+const (
+	extraRedirect = "redirect"
+	extraRecorded = "recorded" // the beat was applied to the session before the reply, ProcessSynchronously
+)
+
+// keys from Server.ReplyFunc are sent with this prefix, so they never clash with directives
+const extraUserPrefix = "x."
+
+// maxUserExtra bound the encoded size of ReplyFunc output, larger output is dropped
+const maxUserExtra = 1024
+
+// addUserExtra merge user key values into extra, return false when they are too large
+func addUserExtra(extra url.Values, user map[string]string) bool {
+	encoded := url.Values{}
+	for k, v := range user {
+		encoded.Set(extraUserPrefix+k, v)
+	}
+	if len(encoded.Encode()) > maxUserExtra {
+		return false
+	}
+	for k, v := range encoded {
+		extra[k] = v
+	}
+	return true
+}
+
+// userExtra return the ReplyFunc key values in extra, without prefix
+func userExtra(extra url.Values) map[string]string {
+	var user map[string]string
+	for k := range extra {
+		if strings.HasPrefix(k, extraUserPrefix) {
+			if user == nil {
+				user = make(map[string]string)
+			}
+			user[strings.TrimPrefix(k, extraUserPrefix)] = extra.Get(k)
+		}
+	}
+	return user
+}
+
+// FrameReply put the signed reply between replyFrameBegin and replyFrameEnd lines, for Server.ReplyTransform
+func FrameReply(signed []byte) []byte {
+	framed := make([]byte, 0, len(replyFrameBegin)+len(signed)+len(replyFrameEnd)+2)
+	framed = append(framed, replyFrameBegin+"\n"...)
+	framed = append(framed, signed...)
+	return append(framed, "\n"+replyFrameEnd...)
+}
+
+// UnframeReply return the signed reply framed by FrameReply in body, for Client.ReplyExtract.
+// Bodies without frame are returned as is, so the client still work with servers not framing.
+func UnframeReply(body []byte) ([]byte, error) {
+	begin := bytes.Index(body, []byte(replyFrameBegin+"\n"))
+	if begin < 0 {
+		return body, nil
+	}
+	signed := body[begin+len(replyFrameBegin)+1:]
+	end := bytes.Index(signed, []byte("\n"+replyFrameEnd))
+	if end < 0 {
+		return nil, errors.New("reply frame not closed")
+	}
+	return signed[:end], nil
+}
+
+const (
+	replyFrameBegin = "-----BEGIN HEARTBEAT REPLY-----"
+	replyFrameEnd   = "-----END HEARTBEAT REPLY-----"
+)
+
+// sendReply write the signed reply through ReplyTransform
+func (s *Server) sendReply(w io.Writer, timestamp string, sg replySigner, extra url.Values) {
+	if s.ReplyTransform == nil {
+		writeReply(w, timestamp, sg, extra)
+		return
+	}
+	buf := &bytes.Buffer{}
+	writeReply(buf, timestamp, sg, extra)
+	w.Write(s.ReplyTransform(buf.Bytes()))
+}
+
+func writeReply(w io.Writer, timestamp string, sg replySigner, extra url.Values) {
+	fmt.Fprintf(w, "%s %s", timestamp, sg.signTimestamp(timestamp))
+	if len(extra) > 0 {
+		encoded := extra.Encode()
+		fmt.Fprintf(w, "\n%s %s", encoded, sg.signExtra(timestamp, encoded))
+	}
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && s != ""
+}
+
+func parseReply(body string, sg replySigner) (timestamp string, extra url.Values, err error) {
+	lines := strings.SplitN(strings.TrimSpace(body), "\n", 3)
+	var hashMAC string
+	if _, err = fmt.Sscanf(lines[0], "%s %s", &timestamp, &hashMAC); err != nil {
+		err = errors.Wrap(err, "parse reply")
+		return
+	}
+	if !sg.verifyTimestamp(timestamp, hashMAC) {
+		err = errors.New("wrong timestamp hmac")
+		return
+	}
+	if len(lines) < 2 {
+		return
+	}
+	fields := strings.Fields(lines[1])
+	if len(fields) != 2 || !isHex(fields[1]) {
+		return // not an extra line, something appended to the reply
+	}
+	encoded, extraMAC := fields[0], fields[1]
+	if !sg.verifyExtra(timestamp, encoded, extraMAC) {
+		err = errors.New("wrong extra hmac")
+		return
+	}
+	extra, err = url.ParseQuery(encoded)
+	return
+}
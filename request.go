@@ -0,0 +1,143 @@
+package heartbeat
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+Client request extra ->
+
+	Query: extra (optional, url encoded key values)
+	Query: extraMAC, HMAC of "{timestamp}:{identifier}:{extra}:extra"
+
+Old servers ignore both fields.
+*/
+
+// field keys in request extra
+const (
+	fieldInterval = "interval" // advertised minimum beat interval, milliseconds
+)
+
+// RequestOptions tune the HTTP request of every beat for proxies and gateways.
+// The zero value is the default: no Expect header, an explicit Content-Length (the body is a small form),
+// and keep-alive connections reused between beats.
+type RequestOptions struct {
+	// Expect100Continue send "Expect: 100-continue", some gateways want it, most only add a round trip
+	Expect100Continue bool
+	// CloseConnection send "Connection: close", every beat open a new connection.
+	// Use it when an intermediary drop idle connections without telling.
+	CloseConnection bool
+	// Header is added to every beat, e.g. a routing header of the gateway
+	Header http.Header
+}
+
+// apply set the options on req
+func (o RequestOptions) apply(req *http.Request) {
+	for k, vs := range o.Header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	if o.Expect100Continue {
+		req.Header.Set("Expect", "100-continue")
+	} else {
+		req.Header.Del("Expect")
+	}
+	req.Close = o.CloseConnection
+}
+
+// requestExtra return the signed fields sent by the client with every beat
+func (c *Client) requestExtra(timestamped bool) url.Values {
+	extra := url.Values{}
+	if c.AdvertiseInterval {
+		extra.Set(fieldInterval, strconv.FormatInt(int64(c.minBeatInterval()/time.Millisecond), 10))
+	}
+	if c.Probe {
+		extra.Set(fieldProbe, "1")
+	}
+	if c.Build != "" {
+		extra.Set(fieldBuild, c.Build)
+	}
+	c.willExtra(extra)
+	c.mu.Lock()
+	if c.restarting() {
+		extra.Set(fieldRestartAck, "1")
+	}
+	if c.bye {
+		extra.Set(fieldBye, "1")
+	}
+	c.statusExtra(extra)
+	c.gapExtra(extra, timestamped)
+	if acks := c.pendingAcks(); len(acks) > 0 {
+		extra[fieldAck] = acks
+	}
+	c.mu.Unlock()
+	return extra
+}
+
+// minBeatInterval return the shortest interval the client beat at
+func (c *Client) minBeatInterval() time.Duration {
+	base := c.BeatInterval
+	if base <= 0 {
+		base = defaultBeatInterval
+	}
+	if c.Adaptive && c.MinInterval > 0 && c.MinInterval < base {
+		return c.MinInterval
+	}
+	return base
+}
+
+// BuildBeatRequest return the beat a Client with secret would send at timestamp (unix seconds,
+// empty for the handshake), signed with HMAC, for tests and tools speaking the protocol without a Client.
+// extra is signed as request extra when not empty.
+func BuildBeatRequest(serverAddr, identifier, secret, timestamp string, extra url.Values) (*http.Request, error) {
+	form := url.Values{
+		"timestamp":  {timestamp},
+		"identifier": {identifier},
+		"messageMAC": {hashIdentifier(timestamp, identifier, secret)}}
+	if len(extra) > 0 {
+		encoded := extra.Encode()
+		form.Set("extra", encoded)
+		form.Set("extraMAC", hashRequestExtra(timestamp, identifier, encoded, secret))
+	}
+	return newBeatRequest(serverAddr, form)
+}
+
+func newBeatRequest(serverAddr string, form url.Values) (*http.Request, error) {
+	payload := form.Encode()
+	req, err := http.NewRequest("POST", serverAddr, strings.NewReader(payload))
+	if err != nil {
+		return nil, errors.Wrap(err, "new request")
+	}
+	req.ContentLength = int64(len(payload))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// readRequestExtra verify and return the request extra, empty if none sent
+func readRequestExtra(r *http.Request, timestamp, identifier, secret string) (url.Values, error) {
+	encoded := r.FormValue("extra")
+	if encoded == "" {
+		return url.Values{}, nil
+	}
+	if !hmac.Equal([]byte(r.FormValue("extraMAC")), []byte(hashRequestExtra(timestamp, identifier, encoded, secret))) {
+		return nil, errors.New("extraMAC wrong")
+	}
+	return url.ParseQuery(encoded)
+}
+
+func hashRequestExtra(timestamp, identifier, extra, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%s:%s:%s:extra", timestamp, identifier, extra)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,111 @@
+package heartbeat
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+)
+
+/*
+Graceful restart, used together with Handover:
+
+ 1. Drain(d) on the old server: replies carry the signed directive restart={d in seconds}
+ 2. Clients acknowledge with the signed field restartAck=1 on their next beats, see RestartAcked
+ 3. Handover(ctx, successor) on the old server: it answer 503 from now on
+ 4. During d plus the server timeout, clients retry every second and keep the server
+    timestamp they have, which the successor (same secret) accept. The successor got the
+    session from Handover, so neither side call OnConnect again.
+
+If the successor reject the timestamp, the client fetch a new one without calling OnConnect.
+A failed Handover cancel the announcement like Undrain, the server keep serving its sessions.
+*/
+
+const (
+	extraRestart         = "restart"
+	fieldRestartAck      = "restartAck"
+	restartRetryInterval = time.Second
+)
+
+// Drain announce a restart to clients, expected to make the server unavailable for d.
+// Beats are still accepted, call Handover afterwards, or Undrain to cancel.
+func (s *Server) Drain(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d <= 0 {
+		d = time.Second
+	}
+	s.restartIn = d
+}
+
+// Undrain cancel the restart announced by Drain, replies stop carrying the directive.
+// Clients already told keep retrying fast until their restart window expire.
+func (s *Server) Undrain() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.undrain()
+}
+
+// undrain forget the announced restart and its acknowledges, must hold s.mu
+func (s *Server) undrain() {
+	s.restartIn = 0
+	for _, sess := range s.sessions {
+		sess.restartAcked = false
+	}
+}
+
+// RestartAcked return how many online sessions acknowledged the restart directive
+func (s *Server) RestartAcked() (acked, total int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sess := range s.sessions {
+		if sess.restartAcked {
+			acked++
+		}
+	}
+	return acked, len(s.sessions)
+}
+
+// restartExtra set the restart directive while draining
+func (s *Server) restartExtra(extra url.Values) {
+	s.mu.Lock()
+	d := s.restartIn
+	s.mu.Unlock()
+	if d > 0 {
+		extra.Set(extraRestart, strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10))
+	}
+}
+
+// noteRestartAck remember the restart acknowledge of identifier
+func (s *Server) noteRestartAck(identifier string, extra url.Values) {
+	if extra.Get(fieldRestartAck) == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.sessions[identifier]; ok {
+		sess.restartAcked = true
+	}
+}
+
+// noteRestart handle the restart directive in a reply, must hold c.mu
+func (c *Client) noteRestart(extra url.Values) {
+	secs, _ := strconv.Atoi(extra.Get(extraRestart))
+	if secs <= 0 {
+		return
+	}
+	window := c.ServerTimeout
+	if window <= 0 {
+		window = 3 * c.BeatInterval
+	}
+	c.restartUntil = time.Now().Add(time.Duration(secs)*time.Second + window)
+}
+
+// restarting report whether the server announced a restart that may be in progress, must hold c.mu
+func (c *Client) restarting() bool {
+	return time.Now().Before(c.restartUntil)
+}
+
+// keepTimeKeyOnRestart tell whether a failed beat should be retried with the same server timestamp
+func keepTimeKeyOnRestart(err error) bool {
+	return !IsStaleTimestamp(err) && !isReplayed(err)
+}
@@ -0,0 +1,27 @@
+package heartbeat
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// sessionCacheTransport clone base with TLS session resumption through cache
+func sessionCacheTransport(base http.RoundTripper, cache tls.ClientSessionCache) (*http.Transport, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	bt, ok := base.(*http.Transport)
+	if !ok {
+		return nil, errors.New("tls session cache: Transport must be *http.Transport, set it on the TLS config of the transport instead")
+	}
+	t := bt.Clone()
+	cfg := t.TLSClientConfig.Clone()
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	cfg.ClientSessionCache = cache
+	t.TLSClientConfig = cfg
+	return t, nil
+}
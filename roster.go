@@ -0,0 +1,126 @@
+package heartbeat
+
+import (
+	"sort"
+	"time"
+)
+
+const defaultRosterInterval = time.Second
+
+// roster is the expected identifiers set by SetExpected
+type roster struct {
+	absentSince map[string]time.Time // zero time while present
+	alerted     map[string]bool
+	running     bool
+}
+
+// SetExpected replace the roster of identifiers which should always be online.
+// Every RosterInterval (default 1s) the roster is compared to the live sessions,
+// an identifier absent for over AbsentGrace (default the timeout) is reported once to OnAbsent,
+// and again only after it came back and went away again.
+//
+// Absence is counted from the evaluation which first see it missing,
+// or from SetExpected for identifiers not online, so clients which never connected are reported too.
+// OnAbsent is thus called between AbsentGrace and AbsentGrace+RosterInterval after a client left.
+// An empty roster stop the evaluation.
+func (s *Server) SetExpected(identifiers []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.roster
+	s.roster = roster{
+		absentSince: make(map[string]time.Time, len(identifiers)),
+		alerted:     make(map[string]bool),
+		running:     old.running,
+	}
+	now := s.now()
+	for _, id := range identifiers {
+		if since, ok := old.absentSince[id]; ok {
+			s.roster.absentSince[id] = since
+			s.roster.alerted[id] = old.alerted[id]
+			continue
+		}
+		var since time.Time
+		if _, ok := s.sessions[id]; !ok {
+			since = now
+		}
+		s.roster.absentSince[id] = since
+	}
+	s.metrics().SetGauge(MetricAbsentClients, float64(len(s.roster.alerted)))
+	if len(identifiers) > 0 && !s.roster.running {
+		s.roster.running = true
+		go s.watchRoster()
+	}
+}
+
+// Expected return the sorted roster set by SetExpected
+func (s *Server) Expected() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.roster.absentSince))
+	for id := range s.roster.absentSince {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Absent return the sorted expected identifiers already reported to OnAbsent and still away
+func (s *Server) Absent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.roster.alerted))
+	for id := range s.roster.alerted {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *Server) watchRoster() {
+	interval := s.RosterInterval
+	if interval <= 0 {
+		interval = defaultRosterInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !s.checkRoster(s.now()) {
+			return
+		}
+	}
+}
+
+// checkRoster compare the roster to live sessions, return false once the roster is empty
+func (s *Server) checkRoster(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.roster.absentSince) == 0 {
+		s.roster.running = false
+		return false
+	}
+	grace := s.AbsentGrace
+	if grace <= 0 {
+		grace = s.hbTimeout
+	}
+	for id, since := range s.roster.absentSince {
+		if _, ok := s.sessions[id]; ok {
+			s.roster.absentSince[id] = time.Time{}
+			delete(s.roster.alerted, id)
+			continue
+		}
+		if since.IsZero() {
+			s.roster.absentSince[id] = now
+			continue
+		}
+		if s.roster.alerted[id] || now.Sub(since) < grace {
+			continue
+		}
+		s.roster.alerted[id] = true
+		if s.OnAbsent != nil {
+			id, since := id, since
+			s.callback("OnAbsent", func() { s.OnAbsent(id, since) })
+		}
+	}
+	s.metrics().SetGauge(MetricAbsentClients, float64(len(s.roster.alerted)))
+	return true
+}
@@ -0,0 +1,97 @@
+package heartbeat
+
+import (
+	"math"
+	"time"
+)
+
+// Interarrival summarize the gaps between beats of one session, computed incrementally
+type Interarrival struct {
+	Count    int64         // number of gaps
+	Mean     time.Duration // average gap
+	StdDev   time.Duration
+	MaxGap   time.Duration
+	LastBeat time.Time
+}
+
+// interarrival keep running statistics with Welford's algorithm, constant memory per session
+type interarrival struct {
+	count  int64
+	mean   float64 // nanoseconds
+	m2     float64
+	maxGap time.Duration
+	last   time.Time
+}
+
+// observe record a beat at t, return the gap since the previous beat
+func (ia *interarrival) observe(t time.Time) time.Duration {
+	if ia.last.IsZero() {
+		ia.last = t
+		return 0
+	}
+	gap := t.Sub(ia.last)
+	ia.last = t
+	ia.count++
+	x := float64(gap)
+	delta := x - ia.mean
+	ia.mean += delta / float64(ia.count)
+	ia.m2 += delta * (x - ia.mean)
+	if gap > ia.maxGap {
+		ia.maxGap = gap
+	}
+	return gap
+}
+
+func (ia *interarrival) snapshot() Interarrival {
+	st := Interarrival{Count: ia.count, Mean: time.Duration(ia.mean), MaxGap: ia.maxGap, LastBeat: ia.last}
+	if ia.count > 1 {
+		st.StdDev = time.Duration(math.Sqrt(ia.m2 / float64(ia.count-1)))
+	}
+	return st
+}
+
+// SessionInfo describe one online session
+type SessionInfo struct {
+	Identifier   string
+	RemoteHost   string
+	ConnectedAt  time.Time
+	Timeout      time.Duration
+	Interarrival Interarrival
+
+	Status        string // status document of the last beat
+	StatusVersion int
+
+	Credits float64 // beat credits left, with CreditRate
+	Build   string  // Client.Build of the last beat
+}
+
+// SessionInfo return the info of identifier, ok is false if it is offline
+func (s *Server) SessionInfo(identifier string) (info SessionInfo, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[identifier]
+	if !ok {
+		return SessionInfo{}, false
+	}
+	return SessionInfo{
+		Identifier:   sess.identifier,
+		RemoteHost:   sess.remoteHost,
+		ConnectedAt:  sess.connectedAt,
+		Timeout:      sess.timeout,
+		Interarrival: sess.arrivals.snapshot(),
+
+		Status:        sess.status,
+		StatusVersion: sess.statusVersion,
+
+		Credits: s.remainingCredits(identifier, s.now()),
+		Build:   sess.build,
+	}, true
+}
+
+// observeBeat update the inter-arrival statistics of sess, must hold s.mu
+func (s *Server) observeBeat(sess *Session) {
+	gap := sess.arrivals.observe(s.now())
+	if s.GapThreshold > 0 && gap > s.GapThreshold && s.OnGapExceeded != nil {
+		s.callback("OnGapExceeded", func() { s.OnGapExceeded(sess.identifier, gap) })
+	}
+}
@@ -0,0 +1,39 @@
+package heartbeat
+
+// ShedReason tell why a beat answered with 200 was not fully processed.
+// Rejected beats (an error to the client) are not shed, they show in the request status codes.
+type ShedReason string
+
+const (
+	ShedDraining        ShedReason = "draining"         // accepted right before Handover or Shutdown
+	ShedBlocked         ShedReason = "blocked"          // identifier blocked between accept and update
+	ShedByeWindow       ShedReason = "bye_window"       // late beat after Client.Bye
+	ShedReconnectWindow ShedReason = "reconnect_window" // ReconnectIgnore of ReconnectPolicy
+	ShedSuperseded      ShedReason = "superseded"       // device kicked by LastConnectionWins
+	ShedMemoryBudget    ShedReason = "memory_budget"    // new session while over MemoryBudget
+	ShedGroupQuota      ShedReason = "group_quota"      // group full when the session was about to be created
+	ShedOutOfOrder      ShedReason = "out_of_order"     // overtaken by a later beat of the same identifier
+)
+
+// shed account a beat not recorded in its session, must hold s.mu
+func (s *Server) shed(identifier string, reason ShedReason) {
+	if s.shedCounts == nil {
+		s.shedCounts = make(map[ShedReason]uint64)
+	}
+	s.shedCounts[reason]++
+	s.metrics().IncCounter(MetricShedBeats, "reason", string(reason))
+	if s.OnShed != nil {
+		s.callback("OnShed", func() { s.OnShed(identifier, reason) })
+	}
+}
+
+// Shed return the number of shed beats by reason
+func (s *Server) Shed() map[ShedReason]uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[ShedReason]uint64, len(s.shedCounts))
+	for reason, n := range s.shedCounts {
+		counts[reason] = n
+	}
+	return counts
+}
@@ -0,0 +1,65 @@
+package heartbeat
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Shutdown stop the server for good: beats are refused with 503, the work of beats already accepted
+// is waited for until ctx is done, then every session is dropped without calling OnDisconnect.
+func (s *Server) Shutdown(ctx context.Context) error {
+	_, err := s.shutdown(ctx)
+	return err
+}
+
+// ShutdownExport is Shutdown returning the sessions as MarshalSessions, e.g. to persist them
+// or give them to UnmarshalSessions of the replacement.
+//
+// The export and the stop happen under one hold of the server lock, so the export is exactly
+// the set of sessions at stop time: no beat can change a session after it is exported.
+// When ctx is done before the accepted work finished, the export is still returned with ctx.Err(),
+// beats still queued are then lost, the exported remaining timeouts cover those clients.
+func (s *Server) ShutdownExport(ctx context.Context) ([]byte, error) {
+	states, err := s.shutdown(ctx)
+	data, merr := json.Marshal(states)
+	if merr != nil {
+		return nil, errors.Wrap(merr, "marshal sessions")
+	}
+	return data, err
+}
+
+func (s *Server) shutdown(ctx context.Context) ([]SessionState, error) {
+	s.mu.Lock()
+	s.stopping = true
+	s.mu.Unlock()
+
+	err := s.waitWork(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	states := s.snapshot()
+	for _, sess := range s.sessions {
+		s.removeSession(sess)
+	}
+	s.roster.absentSince = nil
+	return states, err
+}
+
+// waitWork wait until no dispatched session update is running or queued
+func (s *Server) waitWork(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&s.pendingWork) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
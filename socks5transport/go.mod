@@ -0,0 +1,8 @@
+module github.com/codeskyblue/heartbeat/socks5transport
+
+go 1.25.0
+
+require (
+	github.com/pkg/errors v0.8.0
+	golang.org/x/net v0.56.0
+)
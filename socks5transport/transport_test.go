@@ -0,0 +1,168 @@
+package socks5transport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/proxy"
+)
+
+// socks5Server is a minimal SOCKS5 proxy (RFC 1928, username/password of RFC 1929) serving CONNECT only
+type socks5Server struct {
+	ln       net.Listener
+	user     string
+	password string
+
+	mu      sync.Mutex
+	targets []string // CONNECT addresses, as sent by the client
+}
+
+func newSOCKS5Server(t *testing.T, user, password string) *socks5Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socks5Server{ln: ln, user: user, password: password}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *socks5Server) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	// greeting: version, methods
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil || head[0] != 5 {
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return
+	}
+	if s.user == "" {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		// username/password: version, ulen, user, plen, password
+		if _, err := io.ReadFull(r, head); err != nil {
+			return
+		}
+		user := make([]byte, head[1])
+		io.ReadFull(r, user)
+		plen, _ := r.ReadByte()
+		password := make([]byte, plen)
+		io.ReadFull(r, password)
+		if string(user) != s.user || string(password) != s.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+	// request: version, CONNECT, reserved, address type
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil || req[1] != 1 {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(r, ip)
+		host = net.IP(ip).String()
+	case 3:
+		n, _ := r.ReadByte()
+		name := make([]byte, n)
+		io.ReadFull(r, name)
+		host = string(name)
+	default:
+		conn.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	b := make([]byte, 2)
+	io.ReadFull(r, b)
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(b)))
+	target := net.JoinHostPort(host, port)
+	s.mu.Lock()
+	s.targets = append(s.targets, target)
+	s.mu.Unlock()
+	if host == "heartbeat.test" {
+		host = "127.0.0.1" // resolved on the proxy side
+	}
+	upstream, err := net.Dial("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	go io.Copy(upstream, r)
+	io.Copy(conn, upstream)
+}
+
+func TestDialThroughProxy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("1234 mac"))
+	}))
+	defer ts.Close()
+	proxyServer := newSOCKS5Server(t, "kitty", "secret")
+	defer proxyServer.ln.Close()
+
+	transport, err := New(proxyServer.ln.Addr().String(), &proxy.Auth{User: "kitty", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.CloseIdleConnections()
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	resp, err := (&http.Client{Transport: transport}).Post("http://heartbeat.test:"+port, "application/x-www-form-urlencoded",
+		strings.NewReader("identifier=whoami"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "1234 mac" {
+		t.Fatalf("unexpected reply %q", body)
+	}
+	proxyServer.mu.Lock()
+	defer proxyServer.mu.Unlock()
+	if len(proxyServer.targets) != 1 || proxyServer.targets[0] != "heartbeat.test:"+port {
+		t.Fatalf("expect the host sent unresolved to the proxy, got %v", proxyServer.targets)
+	}
+}
+
+func TestAuthFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request should not reach the server")
+	}))
+	defer ts.Close()
+	proxyServer := newSOCKS5Server(t, "kitty", "secret")
+	defer proxyServer.ln.Close()
+	for _, auth := range []*proxy.Auth{{User: "kitty", Password: "wrong"}, nil} {
+		transport, err := New(proxyServer.ln.Addr().String(), auth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = (&http.Client{Transport: transport}).Post(ts.URL, "application/x-www-form-urlencoded",
+			strings.NewReader("identifier=whoami"))
+		if err == nil || !strings.Contains(err.Error(), "socks") {
+			t.Fatalf("auth %+v: expect the proxy refusal as error, got %v", auth, err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package heartbeat
+
+import "strings"
+
+const defaultStaleThreshold = 3
+
+// IsStaleTimestamp report whether err is the server rejecting the timestamp of a beat as outdated
+// or advanced, rather than a network or authentication failure. The client fetch a new timestamp
+// on its own, a repeated stale rejection mean the server timeout is shorter than the beat interval,
+// or the clocks of the servers behind a load balancer disagree.
+func IsStaleTimestamp(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Invalid timestamp")
+}
+
+// isReplayed report whether the server already saw the messageMAC, with ReplayProtection.
+// Retrying with the same server timestamp would be rejected forever, only a new handshake help:
+// the lost reply of an accepted beat is enough to get there.
+func isReplayed(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "messageMAC replayed")
+}
+
+// noteStale count consecutive stale rejections, return the count when it reach StaleThreshold, must hold c.mu
+func (c *Client) noteStale(err error) (count int, report bool) {
+	if !IsStaleTimestamp(err) {
+		if err == nil {
+			c.stale = 0
+		}
+		return 0, false
+	}
+	c.stale++
+	threshold := c.StaleThreshold
+	if threshold <= 0 {
+		threshold = defaultStaleThreshold
+	}
+	return c.stale, c.stale == threshold
+}
+
+// StaleTimestamps return the consecutive beats rejected as stale, zero since the last timestamped success.
+// Over StaleThreshold it is a clock or configuration problem, see IsStaleTimestamp.
+func (c *Client) StaleTimestamps() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stale
+}
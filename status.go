@@ -0,0 +1,72 @@
+package heartbeat
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// field keys of the status document in request extra
+const (
+	fieldStatus        = "status"
+	fieldStatusVersion = "statusVersion"
+	maxStatusBytes     = 4096
+)
+
+// SetStatus set the status document sent (signed) with every beat, and the schema version of it
+func (c *Client) SetStatus(version int, doc string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.statusVersion = version
+	c.status = doc
+}
+
+// statusExtra add the status document to the request extra, must hold c.mu
+func (c *Client) statusExtra(extra url.Values) {
+	if c.status == "" && c.statusVersion == 0 {
+		return
+	}
+	extra.Set(fieldStatus, c.status)
+	extra.Set(fieldStatusVersion, strconv.Itoa(c.statusVersion))
+}
+
+// checkStatus apply StatusVersionPolicy and the size limit to the status document of a beat
+func (s *Server) checkStatus(w http.ResponseWriter, extra url.Values) bool {
+	if len(extra.Get(fieldStatus)) > maxStatusBytes {
+		http.Error(w, "status document too large", http.StatusBadRequest)
+		return false
+	}
+	if s.StatusVersionPolicy == nil || len(extra[fieldStatusVersion]) == 0 {
+		return true
+	}
+	version, err := strconv.Atoi(extra.Get(fieldStatusVersion))
+	if err == nil {
+		err = s.StatusVersionPolicy(version)
+	}
+	if err != nil {
+		http.Error(w, "status version: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// storeStatus keep the status document of a beat on sess, must hold s.mu
+func (s *Server) storeStatus(sess *Session, extra url.Values) {
+	if len(extra[fieldStatusVersion]) == 0 {
+		return
+	}
+	sess.status = extra.Get(fieldStatus)
+	sess.statusVersion, _ = strconv.Atoi(extra.Get(fieldStatusVersion))
+}
+
+// StatusVersions return how many online sessions report each status schema version,
+// to follow the adoption of a new status document
+func (s *Server) StatusVersions() map[int]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[int]int)
+	for _, sess := range s.sessions {
+		counts[sess.statusVersion]++
+	}
+	return counts
+}
@@ -0,0 +1,79 @@
+package heartbeat
+
+import (
+	"net/http"
+
+	"github.com/codeskyblue/realip"
+)
+
+/*
+Last connection wins, with Server.LastConnectionWins ->
+
+Each beat has a fingerprint, FingerprintFunc(r) or by default the client IP.
+Beats are applied in the order they take the server lock, which is the tie-breaking rule:
+
+  - a beat of an online identifier with another fingerprint supersede the session:
+    the old one is disconnected with ReasonSuperseded (OnDisconnect, EventDisconnect),
+    a new one is started for the beat (OnConnect, EventConnect)
+  - the superseded fingerprint, and the ones the old session superseded, are then refused
+    with 409 "session superseded", handshakes included, as long as the new session is online.
+    So the kicked device can not take the session back, and does not ping-pong with the new one.
+  - beats of a superseded fingerprint accepted right before the takeover are shed (ShedSuperseded)
+
+Of several devices taking over at the same time, the last one applied wins, the others are refused.
+At most maxSuperseded fingerprints are remembered per session, the oldest are forgotten.
+
+The 409 is not a permanent error for the client (see permanentError): with the default fingerprint a
+single device changing network, e.g. from Wi-Fi to cellular and back, supersede its own session and is
+refused on its former address until the session it left time out. It keep retrying, at the handshake
+retry interval, and connect again then. Set FingerprintFunc to a device identifier for roaming clients.
+*/
+
+const maxSuperseded = 16
+
+func (s *Server) fingerprint(r *http.Request) string {
+	if s.FingerprintFunc != nil {
+		return s.FingerprintFunc(r)
+	}
+	return realip.FromRequest(r)
+}
+
+// superseded report whether fingerprint was displaced from the session of identifier, must hold s.mu
+func (s *Server) superseded(identifier, fingerprint string) bool {
+	sess, ok := s.sessions[identifier]
+	if !ok {
+		return false
+	}
+	for _, fp := range sess.superseded {
+		if fp == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSuperseded refuse beats from a device kicked by another one
+func (s *Server) checkSuperseded(w http.ResponseWriter, r *http.Request, identifier string) bool {
+	if !s.LastConnectionWins {
+		return true
+	}
+	fingerprint := s.fingerprint(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.superseded(identifier, fingerprint) {
+		http.Error(w, "session superseded", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// takeover disconnect sess for a beat with another fingerprint,
+// return the fingerprints the next session must refuse, must hold s.mu
+func (s *Server) takeover(sess *Session) []string {
+	superseded := append(append([]string(nil), sess.superseded...), sess.fingerprint)
+	if len(superseded) > maxSuperseded {
+		superseded = superseded[len(superseded)-maxSuperseded:]
+	}
+	s.disconnect(sess, ReasonSuperseded)
+	return superseded
+}
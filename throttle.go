@@ -0,0 +1,119 @@
+package heartbeat
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+/*
+Throttles, graduated abuse response between normal and Block ->
+
+Throttle(identifier, policy) apply tighter limits to one subject at runtime. A throttle can only
+tighten, never loosen, the global limits:
+
+	Block              win over a throttle, the subject get 403
+	ThrottlePolicy     checked next: over Rate the request get 429 "identifier throttled"
+	CreditRate         still apply, the request spend a credit as usual
+	GroupQuota         still apply, and a throttled subject never get the credit priority over the group rate
+	commands           NoCommands refuse SendCommand and hold queued commands out of replies,
+	                   MaxCommands lower maxPendingCommands for the subject
+
+Throttles live in memory only, until ClearThrottle or the For of the policy elapsed.
+*/
+
+// ThrottlePolicy is the override applied to one subject
+type ThrottlePolicy struct {
+	Rate        float64       // requests per second, 0 for no own rate
+	Burst       int           // bucket size with Rate, default 1
+	MaxCommands int           // pending commands allowed, 0 for the default maxPendingCommands
+	NoCommands  bool          // no command queued or delivered
+	For         time.Duration // lifted after For, 0 until ClearThrottle
+}
+
+// ThrottleInfo is an active throttle
+type ThrottleInfo struct {
+	Identifier string
+	Policy     ThrottlePolicy
+	Since      time.Time
+	Refused    uint64 // requests refused by the throttle rate
+}
+
+type throttle struct {
+	policy  ThrottlePolicy
+	since   time.Time
+	bucket  tokenBucket
+	refused uint64
+}
+
+// Throttle apply policy to identifier, replacing its previous throttle. The online session is kept.
+func (s *Server) Throttle(identifier string, policy ThrottlePolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.throttles == nil {
+		s.throttles = make(map[string]*throttle)
+	}
+	s.throttles[identifier] = &throttle{policy: policy, since: s.now()}
+}
+
+// ClearThrottle lift the throttle of identifier
+func (s *Server) ClearThrottle(identifier string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.throttles, identifier)
+}
+
+// Throttles return the active throttles sorted by identifier
+func (s *Server) Throttles() []ThrottleInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	infos := make([]ThrottleInfo, 0, len(s.throttles))
+	for id := range s.throttles {
+		if t := s.throttled(id, now); t != nil {
+			infos = append(infos, ThrottleInfo{Identifier: id, Policy: t.policy, Since: t.since, Refused: t.refused})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Identifier < infos[j].Identifier })
+	return infos
+}
+
+// throttled return the active throttle of identifier, dropping an elapsed one, must hold s.mu
+func (s *Server) throttled(identifier string, now time.Time) *throttle {
+	t, ok := s.throttles[identifier]
+	if !ok {
+		return nil
+	}
+	if t.policy.For > 0 && now.Sub(t.since) >= t.policy.For {
+		delete(s.throttles, identifier)
+		return nil
+	}
+	return t
+}
+
+// admitThrottled apply the throttle rate of identifier, must hold s.mu
+func (s *Server) admitThrottled(w http.ResponseWriter, t *throttle, now time.Time) bool {
+	if t == nil || t.policy.Rate <= 0 {
+		return true
+	}
+	if !t.bucket.take(now, t.policy.Rate, t.policy.Burst) {
+		t.refused++
+		http.Error(w, "identifier throttled", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// commandLimit return how many commands identifier can have pending, must hold s.mu
+func (s *Server) commandLimit(identifier string) int {
+	t := s.throttled(identifier, s.now())
+	switch {
+	case t == nil:
+		return maxPendingCommands
+	case t.policy.NoCommands:
+		return 0
+	case t.policy.MaxCommands > 0 && t.policy.MaxCommands < maxPendingCommands:
+		return t.policy.MaxCommands
+	}
+	return maxPendingCommands
+}
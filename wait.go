@@ -0,0 +1,72 @@
+package heartbeat
+
+import (
+	"context"
+	"strings"
+)
+
+// permanentError return err if retrying can not fix it, e.g. secret wrong or identifier blocked.
+// DoBeat back off exponentially on them, see backoff.go.
+func permanentError(err error) error {
+	msg := err.Error()
+	if strings.Contains(msg, "messageMAC wrong") || strings.Contains(msg, "identifier blocked") ||
+		strings.Contains(msg, "signature required") ||
+		strings.Contains(msg, "key revoked") || strings.Contains(msg, "build below minimum") ||
+		strings.Contains(msg, "build required") || strings.Contains(msg, "status version") ||
+		strings.Contains(msg, "status document too large") || strings.Contains(msg, "last will too large") ||
+		strings.Contains(msg, "interval not advertised") {
+		return err
+	}
+	return nil
+}
+
+// setState update connection state and wake up WaitConnected, must hold c.mu
+func (c *Client) setState(established bool, permErr error) {
+	if c.established == established && c.permErr == permErr {
+		return
+	}
+	c.established = established
+	c.permErr = permErr
+	if c.changed != nil {
+		close(c.changed)
+		c.changed = nil
+	}
+}
+
+// Connected report whether the last beat established the session on server
+func (c *Client) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.established
+}
+
+// WaitConnected block until the session is established on server, ctx is done,
+// or a permanent failure (wrong secret, blocked identifier) happen.
+// Transient failures are retried by the beat loop and don't end the wait.
+//
+// WaitConnected does not send beats itself, start Beat (or drive DoBeat) before calling it.
+func (c *Client) WaitConnected(ctx context.Context) error {
+	for {
+		c.mu.Lock()
+		if c.established {
+			c.mu.Unlock()
+			return nil
+		}
+		if c.permErr != nil {
+			err := c.permErr
+			c.mu.Unlock()
+			return err
+		}
+		if c.changed == nil {
+			c.changed = make(chan struct{})
+		}
+		changed := c.changed
+		c.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
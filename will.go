@@ -0,0 +1,62 @@
+package heartbeat
+
+import (
+	"net/http"
+	"net/url"
+)
+
+/*
+Last will ->
+
+	Request extra: will, the Client.LastWill, at most maxWillBytes
+
+The will is sent (signed) with every beat, so a session created by any beat, e.g. after a server
+restart, has it. The server keep the will of the last beat on the session and deliver it only when
+the session time out, the client vanished without a word:
+
+	disconnect reason       will delivered
+	ReasonTimeout           yes: OnLastWill, and LastWill of EventDisconnect
+	ReasonBye               no, the client left on purpose
+	ReasonBlocked           no, the server decided
+	ReasonSuperseded        no, the client is online on another device
+	ReasonConnectionClosed  no, DisconnectOnClose tell the client closed its connection
+
+Sessions moved by Handover keep their will. An empty will clear the stored one.
+*/
+
+const (
+	fieldWill    = "will"
+	maxWillBytes = 1024
+)
+
+// willExtra add the last will to the request extra
+func (c *Client) willExtra(extra url.Values) {
+	if c.LastWill != "" {
+		extra.Set(fieldWill, c.LastWill)
+	}
+}
+
+// checkWill refuse a last will over maxWillBytes, at handshake too
+func (s *Server) checkWill(w http.ResponseWriter, extra url.Values) bool {
+	if len(extra.Get(fieldWill)) > maxWillBytes {
+		http.Error(w, "last will too large", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// storeWill keep the last will of a beat on sess, must hold s.mu
+func (s *Server) storeWill(sess *Session, extra url.Values) {
+	if extra == nil {
+		return // no extra given, keep the will
+	}
+	sess.will = extra.Get(fieldWill)
+}
+
+// lastWill return the will to deliver for sess, just disconnected
+func lastWill(sess *Session) string {
+	if sess.reason != ReasonTimeout {
+		return ""
+	}
+	return sess.will
+}
@@ -0,0 +1,93 @@
+package heartbeat
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"strconv"
+	"time"
+)
+
+/*
+Time windowed keys, with KeyWindow set on both Server and Client ->
+
+The HMAC key of a beat and of its reply is not the secret but a key derived for the time window:
+
+	window = floor(unix seconds / KeyWindow)
+	key    = HKDF-SHA256(secret, salt "heartbeat window key", info "{window}"), 32 bytes
+
+The client derive the key of its current window, by its own clock. The server try its current window
+and KeyWindowSkew (default 1) windows on each side, and sign the reply with the key that matched,
+so a clock skew up to KeyWindowSkew*KeyWindow is tolerated. Pick KeyWindow well above the expected skew
+and the server timeout, e.g. 5 minutes: past the tolerance beats fail with "messageMAC wrong".
+
+Security properties: a derived key leaked, e.g. from the memory of a client holding only window keys,
+let an attacker forge beats for that window and its neighbours, not before nor after. MACs captured on
+the wire verify against one window only, on top of the timestamp and replay checks. A leaked secret is
+still game over, the derivation do not replace rotating it (Reconfigure).
+Handshakes and beats are derived alike, Ed25519 and AuthFunc beats are not concerned.
+
+KeyWindowLegacy make the server also accept the plain secret, to upgrade clients one by one.
+*/
+
+const (
+	keyWindowSalt        = "heartbeat window key"
+	defaultKeyWindowSkew = 1
+	windowKeySize        = sha256.Size
+)
+
+// windowKey derive the key of window from secret, HKDF (RFC 5869) with one block of output
+func windowKey(secret string, window int64) string {
+	extract := hmac.New(sha256.New, []byte(keyWindowSalt))
+	extract.Write([]byte(secret))
+	prk := extract.Sum(nil)
+	expand := hmac.New(sha256.New, prk)
+	expand.Write([]byte(strconv.FormatInt(window, 10)))
+	expand.Write([]byte{1})
+	return string(expand.Sum(nil)[:windowKeySize])
+}
+
+func keyWindowOf(t time.Time, window time.Duration) int64 {
+	return t.Unix() / int64(window/time.Second)
+}
+
+// hmacKey return the key the client sign with now
+func (c *Client) hmacKey(now time.Time) string {
+	if c.KeyWindow < time.Second {
+		return c.Secret
+	}
+	return windowKey(c.Secret, keyWindowOf(now, c.KeyWindow))
+}
+
+// matchKey return the key messageMAC was made with, ok is false when none of the accepted keys match
+func (s *Server) matchKey(timestamp, identifier, secret, messageMAC string) (key string, ok bool) {
+	macOK := func(key string) bool {
+		return hmac.Equal([]byte(messageMAC), []byte(hashIdentifier(timestamp, identifier, key)))
+	}
+	if s.KeyWindow < time.Second {
+		return secret, macOK(secret)
+	}
+	skew := int64(s.KeyWindowSkew)
+	if skew <= 0 {
+		skew = defaultKeyWindowSkew
+	}
+	current := keyWindowOf(s.now(), s.KeyWindow)
+	// current window first, the common case
+	for _, d := range append([]int64{0}, skewOrder(skew)...) {
+		if key := windowKey(secret, current+d); macOK(key) {
+			return key, true
+		}
+	}
+	if s.KeyWindowLegacy && macOK(secret) {
+		return secret, true
+	}
+	return "", false
+}
+
+// skewOrder return -1, 1, -2, 2 ... up to skew
+func skewOrder(skew int64) []int64 {
+	order := make([]int64, 0, 2*skew)
+	for d := int64(1); d <= skew; d++ {
+		order = append(order, -d, d)
+	}
+	return order
+}
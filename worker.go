@@ -0,0 +1,85 @@
+package heartbeat
+
+import (
+	"net/http"
+	"net/url"
+	"sync/atomic"
+)
+
+// applyBeat update the session of identifier with the beat of r, ok is false when it could not be queued.
+// recorded is true when the session was updated before returning, only with ProcessSynchronously.
+//
+// With ProcessSynchronously the update run in the request before the reply: a 200 mean the session
+// is online (or the beat counted as shed, see Shed) and OnConnect was called, at the cost of the
+// server lock being on the reply latency. By default the update is dispatched and the reply sent at once,
+// faster, but a 200 only mean the beat was accepted: a client beating again right away may be answered
+// before its first beat is applied.
+//
+// In both modes beats are numbered in arrival order before the update, and a beat overtaken by a later one
+// of the same identifier is shed (ShedOutOfOrder) instead of applied over it, so an early beat
+// applied late can not connect twice, count a stale status or take a session back.
+func (s *Server) applyBeat(identifier string, r *http.Request, extra url.Values) (recorded, ok bool) {
+	seq := atomic.AddUint64(&s.beatSeq, 1)
+	update := func() {
+		s.withLabels(identifier, func() { recorded = s.updateOrSaveSession(identifier, r, extra, seq) })
+	}
+	if !s.ProcessSynchronously {
+		return false, s.dispatch(update)
+	}
+	atomic.AddInt64(&s.pendingWork, 1) // for Shutdown, as dispatch
+	defer atomic.AddInt64(&s.pendingWork, -1)
+	update()
+	return recorded, true
+}
+
+// dispatch run the session update of a request in the background.
+//
+// Without MaxWorkers every request start its own goroutine, so a surge start as many goroutines.
+// With MaxWorkers, MaxWorkers goroutines take work from a queue of WorkQueue (default 16*MaxWorkers) entries.
+// When the queue is full the request is rejected with 503 rather than growing memory,
+// and under load a beat wait in the queue before its session is updated, which add latency
+// to presence but not to the reply.
+func (s *Server) dispatch(fn func()) bool {
+	atomic.AddInt64(&s.pendingWork, 1) // until fn returned, for Shutdown
+	if s.MaxWorkers <= 0 {
+		go s.work(fn)
+		return true
+	}
+	s.poolOnce.Do(func() {
+		size := s.WorkQueue
+		if size <= 0 {
+			size = 16 * s.MaxWorkers
+		}
+		s.queue = make(chan func(), size)
+		for i := 0; i < s.MaxWorkers; i++ {
+			go func() {
+				for fn := range s.queue {
+					s.work(fn)
+				}
+			}()
+		}
+	})
+	select {
+	case s.queue <- fn:
+		return true
+	default:
+		atomic.AddInt64(&s.pendingWork, -1)
+		atomic.AddUint64(&s.rejectedWork, 1)
+		return false
+	}
+}
+
+func (s *Server) work(fn func()) {
+	s.metrics().SetGauge(MetricBusyWorkers, float64(atomic.AddInt64(&s.busyWorkers, 1)))
+	defer func() {
+		s.metrics().SetGauge(MetricBusyWorkers, float64(atomic.AddInt64(&s.busyWorkers, -1)))
+		atomic.AddInt64(&s.pendingWork, -1)
+	}()
+	fn()
+}
+
+// Workers return the goroutines busy with request side work, the work waiting in queue,
+// and how many requests were rejected because the queue was full
+func (s *Server) Workers() (busy, queued int, rejected uint64) {
+	return int(atomic.LoadInt64(&s.busyWorkers)), len(s.queue), atomic.LoadUint64(&s.rejectedWork)
+}